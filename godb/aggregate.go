@@ -0,0 +1,407 @@
+package godb
+
+import (
+	"errors"
+	"github.com/ian-kent/go-log/log"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+var ErrUnknownStage = errors.New("Unknown aggregation stage")
+var ErrInvalidStage = errors.New("Invalid aggregation stage argument")
+
+// Stage is one step of an aggregation pipeline, created with Match,
+// Group, Sort, Limit, Skip, Project or Unwind
+type Stage struct {
+	Op  string
+	Arg interface{}
+}
+
+// Accumulator computes a value over the documents in a group, created
+// with Count, Sum, Avg, Min, Max or Push
+type Accumulator struct {
+	Op    string
+	Field string
+}
+
+// Accumulators names the fields a $group stage computes
+type Accumulators map[string]Accumulator
+
+type groupArg struct {
+	By  []string
+	Acc Accumulators
+}
+
+// Match filters documents with a query, as passed to Find
+func Match(query interface{}) Stage {
+	return Stage{Op: "$match", Arg: query}
+}
+
+// Group combines documents with equal values of the by fields into one
+// document holding those fields and the accumulated fields, e.g.
+//
+//	godb.Group([]string{"Age"}, godb.Accumulators{"Count": godb.Count()})
+func Group(by []string, acc Accumulators) Stage {
+	return Stage{Op: "$group", Arg: groupArg{By: by, Acc: acc}}
+}
+
+func Sort(fields ...SortField) Stage {
+	return Stage{Op: "$sort", Arg: fields}
+}
+
+func Limit(n int) Stage {
+	return Stage{Op: "$limit", Arg: n}
+}
+
+func Skip(n int) Stage {
+	return Stage{Op: "$skip", Arg: n}
+}
+
+// Project keeps only the listed fields
+func Project(fields ...string) Stage {
+	return Stage{Op: "$project", Arg: fields}
+}
+
+// Unwind replaces each document whose field holds a slice with one
+// document per element. Documents with an empty or missing field are
+// dropped.
+func Unwind(field string) Stage {
+	return Stage{Op: "$unwind", Arg: field}
+}
+
+// Count counts the documents in the group
+func Count() Accumulator {
+	return Accumulator{Op: "$count"}
+}
+
+// Sum adds the numeric values of field. The sum is an int64 if every
+// value is an integer, otherwise a float64.
+func Sum(field string) Accumulator {
+	return Accumulator{Op: "$sum", Field: field}
+}
+
+// Avg averages the numeric values of field as a float64
+func Avg(field string) Accumulator {
+	return Accumulator{Op: "$avg", Field: field}
+}
+
+func Min(field string) Accumulator {
+	return Accumulator{Op: "$min", Field: field}
+}
+
+func Max(field string) Accumulator {
+	return Accumulator{Op: "$max", Field: field}
+}
+
+// Push collects the values of field into a slice
+func Push(field string) Accumulator {
+	return Accumulator{Op: "$push", Field: field}
+}
+
+// Aggregate runs the documents through the pipeline stages in turn and
+// returns the resulting documents. A $match at the front of the
+// pipeline, and any $sort, $skip and $limit directly after it, are run
+// as a Find and can use indexes. The results are copies and aren't
+// stored.
+func (db *Database) Aggregate(stages ...Stage) ([]*Document, error) {
+	for _, s := range stages {
+		if err := s.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	fields := make(map[string]interface{})
+	opts := FindOptions{}
+	i := 0
+	if i < len(stages) && stages[i].Op == "$match" {
+		fields = queryFields(stages[i].Arg)
+		i++
+	}
+	if i < len(stages) && stages[i].Op == "$sort" {
+		opts.Sort = stages[i].Arg.([]SortField)
+		i++
+	}
+	if i < len(stages) && stages[i].Op == "$skip" {
+		opts.Start = stages[i].Arg.(int)
+		i++
+	}
+	if i < len(stages) && stages[i].Op == "$limit" {
+		opts.Limit = stages[i].Arg.(int)
+		i++
+	}
+
+	docs := db.aggregateInput(fields, opts)
+
+	for _, s := range stages[i:] {
+		log.Trace("Aggregation stage %s on %d documents", s.Op, len(docs))
+		switch s.Op {
+		case "$match":
+			docs = aggregateMatch(docs, queryFields(s.Arg))
+		case "$group":
+			docs = aggregateGroup(docs, s.Arg.(groupArg))
+		case "$sort":
+			docs = aggregateSort(docs, s.Arg.([]SortField))
+		case "$skip":
+			docs = page(docs, s.Arg.(int), 0)
+		case "$limit":
+			docs = page(docs, 0, s.Arg.(int))
+		case "$project":
+			opts := FindOptions{Include: s.Arg.([]string)}
+			for j, d := range docs {
+				docs[j] = project(d, d.Fields, opts)
+			}
+		case "$unwind":
+			docs = aggregateUnwind(docs, s.Arg.(string))
+		}
+	}
+
+	return docs, nil
+}
+
+func (s Stage) validate() error {
+	ok := false
+	switch s.Op {
+	case "$match":
+		ok = true
+	case "$group":
+		_, ok = s.Arg.(groupArg)
+	case "$sort":
+		_, ok = s.Arg.([]SortField)
+	case "$skip":
+		n, isInt := s.Arg.(int)
+		ok = isInt && n >= 0
+	case "$limit":
+		n, isInt := s.Arg.(int)
+		ok = isInt && n > 0
+	case "$project":
+		_, ok = s.Arg.([]string)
+	case "$unwind":
+		_, ok = s.Arg.(string)
+	default:
+		return ErrUnknownStage
+	}
+	if !ok {
+		return ErrInvalidStage
+	}
+	return nil
+}
+
+// aggregateInput finds the documents to aggregate and copies them so
+// that the stages can change them
+func (db *Database) aggregateInput(fields map[string]interface{}, opts FindOptions) []*Document {
+	db.WriteLock.RLock()
+	defer db.WriteLock.RUnlock()
+
+	_, found := db.find(fields, opts, nil)
+	docs := make([]*Document, len(found))
+	for i, d := range found {
+		docs[i] = project(d, d.Values(), FindOptions{})
+	}
+	return docs
+}
+
+func aggregateMatch(docs []*Document, fields map[string]interface{}) []*Document {
+	matched := make([]*Document, 0)
+	for _, d := range docs {
+		if matchFields(d, d.Fields, fields) {
+			matched = append(matched, d)
+		}
+	}
+	return matched
+}
+
+func aggregateSort(docs []*Document, fields []SortField) []*Document {
+	sds := make([]*sortDoc, len(docs))
+	for i, d := range docs {
+		sds[i] = &sortDoc{doc: d, key: sortKey(d, d.Fields, fields), seq: i}
+	}
+	sort.Slice(sds, func(i, j int) bool {
+		return less(sds[i], sds[j], fields)
+	})
+	sorted := make([]*Document, len(docs))
+	for i, sd := range sds {
+		sorted[i] = sd.doc
+	}
+	return sorted
+}
+
+func aggregateUnwind(docs []*Document, field string) []*Document {
+	unwound := make([]*Document, 0)
+	for _, d := range docs {
+		v, ok := lookupPath(d.Fields, field)
+		if !ok || v == nil {
+			continue
+		}
+		rv := reflect.ValueOf(v)
+		if (rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array) || isBytes(rv) {
+			unwound = append(unwound, d)
+			continue
+		}
+		if _, ok := withPath(d.Fields, field, nil); !ok {
+			// the values were collected through a slice, so have
+			// no single place to be unwound to
+			unwound = append(unwound, d)
+			continue
+		}
+		for i := 0; i < rv.Len(); i++ {
+			fields, _ := withPath(d.Fields, field, rv.Index(i).Interface())
+			unwound = append(unwound, &Document{ObjectID: d.ObjectID, Fields: fields})
+		}
+	}
+	return unwound
+}
+
+// withPath returns a copy of values with the value at a field path set,
+// copying the nested maps along a dotted path so the original is left
+// unchanged. It returns false if the path passes through a value which
+// isn't a map.
+func withPath(values map[string]interface{}, path string, v interface{}) (map[string]interface{}, bool) {
+	m := make(map[string]interface{}, len(values)+1)
+	for k, e := range values {
+		m[k] = e
+	}
+	i := strings.IndexByte(path, '.')
+	if _, ok := values[path]; ok || i < 0 {
+		m[path] = v
+		return m, true
+	}
+
+	inner, ok := values[path[:i]].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	if m[path[:i]], ok = withPath(inner, path[i+1:], v); !ok {
+		return nil, false
+	}
+	return m, true
+}
+
+// group holds the state of one $group output document
+type group struct {
+	doc    *Document
+	sums   map[string]*sum
+	values map[string][]interface{}
+}
+
+type sum struct {
+	i     int64
+	f     float64
+	n     int
+	float bool
+}
+
+func (s *sum) add(v interface{}) {
+	if !isNumber(v) {
+		return
+	}
+	rv := reflect.ValueOf(v)
+	switch {
+	case isInt(rv):
+		s.i += rv.Int()
+		s.f += float64(rv.Int())
+	case isUint(rv):
+		s.i += int64(rv.Uint())
+		s.f += float64(rv.Uint())
+	default:
+		s.f += rv.Float()
+		s.float = true
+	}
+	s.n++
+}
+
+func aggregateGroup(docs []*Document, arg groupArg) []*Document {
+	groups := make([]*group, 0)
+	byKey := make(map[string]*group)
+
+	for _, d := range docs {
+		key := groupKey(d.Fields, arg.By)
+		g, ok := byKey[key]
+		if !ok {
+			g = &group{
+				doc:    &Document{Fields: make(map[string]interface{})},
+				sums:   make(map[string]*sum),
+				values: make(map[string][]interface{}),
+			}
+			for _, f := range arg.By {
+				g.doc.Fields[f], _ = lookupPath(d.Fields, f)
+			}
+			byKey[key] = g
+			groups = append(groups, g)
+		}
+
+		for name, acc := range arg.Acc {
+			v, exists := lookupPath(d.Fields, acc.Field)
+			switch acc.Op {
+			case "$count":
+				n, _ := g.doc.Fields[name].(int)
+				g.doc.Fields[name] = n + 1
+			case "$sum", "$avg":
+				s, ok := g.sums[name]
+				if !ok {
+					s = &sum{}
+					g.sums[name] = s
+				}
+				s.add(v)
+			case "$min", "$max":
+				if !exists || v == nil {
+					continue
+				}
+				cur, ok := g.doc.Fields[name]
+				c := orderValues(v, cur)
+				if !ok || (acc.Op == "$min" && c < 0) || (acc.Op == "$max" && c > 0) {
+					g.doc.Fields[name] = v
+				}
+			case "$push":
+				if exists {
+					g.values[name] = append(g.values[name], v)
+				}
+			}
+		}
+	}
+
+	results := make([]*Document, len(groups))
+	for i, g := range groups {
+		for name, acc := range arg.Acc {
+			switch acc.Op {
+			case "$sum":
+				s := g.sums[name]
+				if s.float {
+					g.doc.Fields[name] = s.f
+				} else {
+					g.doc.Fields[name] = s.i
+				}
+			case "$avg":
+				s := g.sums[name]
+				if s.n == 0 {
+					g.doc.Fields[name] = nil
+				} else {
+					g.doc.Fields[name] = s.f / float64(s.n)
+				}
+			case "$min", "$max":
+				if _, ok := g.doc.Fields[name]; !ok {
+					g.doc.Fields[name] = nil
+				}
+			case "$push":
+				vs := g.values[name]
+				if vs == nil {
+					vs = make([]interface{}, 0)
+				}
+				g.doc.Fields[name] = vs
+			}
+		}
+		results[i] = g.doc
+	}
+	return results
+}
+
+// groupKey returns a key identifying the values of the fields, by the
+// canonical encoding so equal numbers of any type share a group
+func groupKey(values map[string]interface{}, fields []string) string {
+	b := make([]byte, 0)
+	for _, f := range fields {
+		fv, _ := lookupPath(values, f)
+		b = appendHashValue(b, fv)
+	}
+	return string(b)
+}
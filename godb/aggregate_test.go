@@ -0,0 +1,135 @@
+package godb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+)
+
+type TestAgeGroup struct {
+	Age   int
+	Count int
+	Total int
+}
+
+func TestAggregate(t *testing.T) {
+	db := NewDatabase()
+	db.NewIndexWithOptions([]string{"Age"}, Ordered())
+	for i := 0; i < 100; i++ {
+		db.Insert(&TestDoc{
+			Name: "Test document " + strconv.Itoa(i),
+			Age:  i % 5,
+		})
+	}
+
+	docs, err := db.Aggregate(
+		Match(Q{"Age": Gte(2)}),
+		Group([]string{"Age"}, Accumulators{
+			"Count": Count(),
+			"Total": Sum("Age"),
+			"Avg":   Avg("Age"),
+			"First": Min("Name"),
+			"Last":  Max("Name"),
+			"Names": Push("Name"),
+		}),
+		Sort(Desc("Age")),
+	)
+	assert.Nil(t, err, "no error aggregating")
+	assert.Equal(t, len(docs), 3, "one document per age")
+
+	var g TestAgeGroup
+	docs[0].Unmarshal(&g)
+	assert.Equal(t, g, TestAgeGroup{Age: 4, Count: 20, Total: 80})
+	assert.Equal(t, docs[0].Fields["Avg"], 4.0)
+	assert.Equal(t, docs[0].Fields["First"], "Test document 14")
+	assert.Equal(t, docs[0].Fields["Last"], "Test document 99")
+	assert.Equal(t, len(docs[0].Fields["Names"].([]interface{})), 20)
+	docs[2].Unmarshal(&g)
+	assert.Equal(t, g.Age, 2, "groups are sorted")
+
+	docs, err = db.Aggregate(
+		Sort(Asc("Age"), Desc("Name")),
+		Skip(10),
+		Limit(5),
+		Project("Name"),
+	)
+	assert.Nil(t, err, "no error aggregating")
+	assert.Equal(t, len(docs), 5, "limit is applied")
+	assert.Equal(t, docs[0].Fields, map[string]interface{}{"Name": "Test document 5"})
+
+	docs, err = db.Aggregate(
+		Match(Q{"Age": 0}),
+		Group([]string{"Age"}, Accumulators{"Names": Push("Name")}),
+		Unwind("Names"),
+		Match(Q{"Names": Prefix("Test document 9")}),
+	)
+	assert.Nil(t, err, "no error aggregating")
+	assert.Equal(t, len(docs), 2, "unwound documents are matched")
+	assert.Equal(t, docs[0].Fields["Names"], "Test document 90")
+
+	_, err = db.Aggregate(Stage{Op: "$out"})
+	assert.Equal(t, err, ErrUnknownStage)
+	_, err = db.Aggregate(Limit(-1))
+	assert.Equal(t, err, ErrInvalidStage)
+
+	n, _ := db.Find(nil, 0, 0)
+	assert.Equal(t, n, 100, "stored documents are unchanged")
+	assert.Equal(t, len(db.Documents[0].Fields), 2, "stored documents are unchanged")
+}
+
+func TestAggregateNestedPaths(t *testing.T) {
+	db := NewDatabase()
+	for i := 0; i < 10; i++ {
+		db.Insert(&TestPerson{
+			Name:    "Test person " + strconv.Itoa(i),
+			Address: TestAddress{City: "City " + strconv.Itoa(i%2)},
+			Scores:  map[string]int{"Maths": i},
+		})
+	}
+	db.Insert(map[string]interface{}{
+		"Name":    "Test person 10",
+		"Address": map[string]interface{}{"City": "City 0", "Streets": []interface{}{"a", "b"}},
+	})
+
+	docs, err := db.Aggregate(
+		Group([]string{"Address.City"}, Accumulators{
+			"Count": Count(),
+			"Total": Sum("Scores.Maths"),
+			"Best":  Max("Scores.Maths"),
+		}),
+		Sort(Asc("Address.City")),
+	)
+	assert.Nil(t, err, "no error aggregating")
+	if assert.Equal(t, len(docs), 2, "one group per city") {
+		assert.Equal(t, docs[0].Fields, map[string]interface{}{"Address.City": "City 0", "Count": 6, "Total": int64(20), "Best": 8})
+		assert.Equal(t, docs[1].Fields, map[string]interface{}{"Address.City": "City 1", "Count": 5, "Total": int64(25), "Best": 9})
+	}
+
+	docs, err = db.Aggregate(
+		Match(Q{"Name": "Test person 10"}),
+		Unwind("Address.Streets"),
+	)
+	assert.Nil(t, err, "no error aggregating")
+	if assert.Equal(t, len(docs), 2, "nested list is unwound") {
+		assert.Equal(t, docs[1].Fields["Address"], map[string]interface{}{"City": "City 0", "Streets": "b"})
+	}
+	_, stored := db.Find(Q{"Name": "Test person 10"}, 0, 0)
+	assert.Equal(t, stored[0].Fields["Address"].(map[string]interface{})["Streets"], []interface{}{"a", "b"}, "stored document is unchanged")
+}
+
+func TestAggregateGroupsEqualNumbers(t *testing.T) {
+	db := NewDatabase()
+	db.Insert(
+		map[string]interface{}{"A": 1},
+		map[string]interface{}{"A": 1.0},
+		map[string]interface{}{"A": int64(1)},
+		map[string]interface{}{"A": 1.5},
+	)
+
+	docs, err := db.Aggregate(Group([]string{"A"}, Accumulators{"Count": Count()}), Sort(Asc("A")))
+	assert.Nil(t, err, "no error aggregating")
+	if assert.Equal(t, len(docs), 2, "equal numbers of any type share a group") {
+		assert.Equal(t, docs[0].Fields["Count"], 3)
+		assert.Equal(t, len(db.Distinct("A", nil)), 2, "groups match Distinct")
+	}
+}
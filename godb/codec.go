@@ -0,0 +1,365 @@
+package godb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+)
+
+var ErrUnsupportedType = errors.New("Unsupported field type")
+var ErrCorrupt = errors.New("Corrupt record")
+
+// Value type tags used by the binary codec. The tag preserves the
+// concrete Go type so that decoded documents compare equal to the
+// originals (an int stays an int, not an int64).
+const (
+	tagNil byte = iota
+	tagBool
+	tagInt
+	tagInt8
+	tagInt16
+	tagInt32
+	tagInt64
+	tagUint
+	tagUint8
+	tagUint16
+	tagUint32
+	tagUint64
+	tagFloat32
+	tagFloat64
+	tagString
+	tagBytes
+	tagTime
+	tagSlice
+	tagMap
+)
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendBytes(b []byte, v []byte) []byte {
+	b = appendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendString(b []byte, v string) []byte {
+	b = appendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendValue(b []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, tagNil), nil
+	case bool:
+		if v {
+			return append(b, tagBool, 1), nil
+		}
+		return append(b, tagBool, 0), nil
+	case int:
+		return appendVarint(append(b, tagInt), int64(v)), nil
+	case int8:
+		return appendVarint(append(b, tagInt8), int64(v)), nil
+	case int16:
+		return appendVarint(append(b, tagInt16), int64(v)), nil
+	case int32:
+		return appendVarint(append(b, tagInt32), int64(v)), nil
+	case int64:
+		return appendVarint(append(b, tagInt64), v), nil
+	case uint:
+		return appendUvarint(append(b, tagUint), uint64(v)), nil
+	case uint8:
+		return appendUvarint(append(b, tagUint8), uint64(v)), nil
+	case uint16:
+		return appendUvarint(append(b, tagUint16), uint64(v)), nil
+	case uint32:
+		return appendUvarint(append(b, tagUint32), uint64(v)), nil
+	case uint64:
+		return appendUvarint(append(b, tagUint64), v), nil
+	case float32:
+		var buf [4]byte
+		binary.BigEndian.PutUint32(buf[:], math.Float32bits(v))
+		return append(append(b, tagFloat32), buf[:]...), nil
+	case float64:
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], math.Float64bits(v))
+		return append(append(b, tagFloat64), buf[:]...), nil
+	case string:
+		return appendString(append(b, tagString), v), nil
+	case []byte:
+		return appendBytes(append(b, tagBytes), v), nil
+	case time.Time:
+		tb, err := v.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		return appendBytes(append(b, tagTime), tb), nil
+	case []interface{}:
+		b = appendUvarint(append(b, tagSlice), uint64(len(v)))
+		var err error
+		for _, e := range v {
+			if b, err = appendValue(b, e); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]interface{}:
+		return appendFields(append(b, tagMap), v)
+	}
+	if bv, ok := basicValue(reflect.ValueOf(v)); ok {
+		return appendValue(b, bv)
+	}
+	return nil, fmt.Errorf("%s: %T", ErrUnsupportedType, v)
+}
+
+// basicTypes are the unnamed types of the basic kinds the codec writes
+var basicTypes = map[reflect.Kind]reflect.Type{
+	reflect.Bool:    reflect.TypeOf(false),
+	reflect.Int:     reflect.TypeOf(int(0)),
+	reflect.Int8:    reflect.TypeOf(int8(0)),
+	reflect.Int16:   reflect.TypeOf(int16(0)),
+	reflect.Int32:   reflect.TypeOf(int32(0)),
+	reflect.Int64:   reflect.TypeOf(int64(0)),
+	reflect.Uint:    reflect.TypeOf(uint(0)),
+	reflect.Uint8:   reflect.TypeOf(uint8(0)),
+	reflect.Uint16:  reflect.TypeOf(uint16(0)),
+	reflect.Uint32:  reflect.TypeOf(uint32(0)),
+	reflect.Uint64:  reflect.TypeOf(uint64(0)),
+	reflect.Float32: reflect.TypeOf(float32(0)),
+	reflect.Float64: reflect.TypeOf(float64(0)),
+	reflect.String:  reflect.TypeOf(""),
+}
+
+// basicValue returns v as the unnamed type of its kind if it's of a
+// named basic type, such as time.Duration, which is written as its kind
+func basicValue(v reflect.Value) (interface{}, bool) {
+	t, ok := basicTypes[v.Kind()]
+	if !ok || v.Type() == t {
+		return nil, false
+	}
+	return v.Convert(t).Interface(), true
+}
+
+// appendFields writes a field map with its keys in sorted order, so the
+// same document always encodes to the same bytes.
+func appendFields(b []byte, fields map[string]interface{}) ([]byte, error) {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	b = appendUvarint(b, uint64(len(keys)))
+	var err error
+	for _, k := range keys {
+		b = appendString(b, k)
+		if b, err = appendValue(b, fields[k]); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func appendDocument(b []byte, doc *Document) ([]byte, error) {
+	b = appendBytes(b, doc.ObjectID)
+	return appendFields(b, doc.Values())
+}
+
+type decoder struct {
+	buf []byte
+	off int
+}
+
+func (d *decoder) readByte() (byte, error) {
+	if d.off >= len(d.buf) {
+		return 0, ErrCorrupt
+	}
+	c := d.buf[d.off]
+	d.off++
+	return c, nil
+}
+
+func (d *decoder) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(d.buf[d.off:])
+	if n <= 0 {
+		return 0, ErrCorrupt
+	}
+	d.off += n
+	return v, nil
+}
+
+func (d *decoder) varint() (int64, error) {
+	v, n := binary.Varint(d.buf[d.off:])
+	if n <= 0 {
+		return 0, ErrCorrupt
+	}
+	d.off += n
+	return v, nil
+}
+
+func (d *decoder) fixed(n int) ([]byte, error) {
+	if len(d.buf)-d.off < n {
+		return nil, ErrCorrupt
+	}
+	b := d.buf[d.off : d.off+n]
+	d.off += n
+	return b, nil
+}
+
+func (d *decoder) readBytes() ([]byte, error) {
+	l, err := d.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(d.buf)-d.off) < l {
+		return nil, ErrCorrupt
+	}
+	b := make([]byte, l)
+	copy(b, d.buf[d.off:])
+	d.off += int(l)
+	return b, nil
+}
+
+func (d *decoder) readString() (string, error) {
+	b, err := d.readBytes()
+	return string(b), err
+}
+
+func (d *decoder) value() (interface{}, error) {
+	tag, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tag {
+	case tagNil:
+		return nil, nil
+	case tagBool:
+		c, err := d.readByte()
+		return c == 1, err
+	case tagInt, tagInt8, tagInt16, tagInt32, tagInt64:
+		v, err := d.varint()
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case tagInt:
+			return int(v), nil
+		case tagInt8:
+			return int8(v), nil
+		case tagInt16:
+			return int16(v), nil
+		case tagInt32:
+			return int32(v), nil
+		}
+		return v, nil
+	case tagUint, tagUint8, tagUint16, tagUint32, tagUint64:
+		v, err := d.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case tagUint:
+			return uint(v), nil
+		case tagUint8:
+			return uint8(v), nil
+		case tagUint16:
+			return uint16(v), nil
+		case tagUint32:
+			return uint32(v), nil
+		}
+		return v, nil
+	case tagFloat32:
+		b, err := d.fixed(4)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), nil
+	case tagFloat64:
+		b, err := d.fixed(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case tagString:
+		return d.readString()
+	case tagBytes:
+		return d.readBytes()
+	case tagTime:
+		b, err := d.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		var t time.Time
+		err = t.UnmarshalBinary(b)
+		return t, err
+	case tagSlice:
+		l, err := d.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if l > uint64(len(d.buf)-d.off) {
+			return nil, ErrCorrupt
+		}
+		s := make([]interface{}, l)
+		for i := range s {
+			if s[i], err = d.value(); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	case tagMap:
+		return d.fields()
+	}
+
+	return nil, ErrCorrupt
+}
+
+func (d *decoder) fields() (map[string]interface{}, error) {
+	l, err := d.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if l > uint64(len(d.buf)-d.off) {
+		return nil, ErrCorrupt
+	}
+	fields := make(map[string]interface{}, l)
+	for i := uint64(0); i < l; i++ {
+		k, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		if fields[k], err = d.value(); err != nil {
+			return nil, err
+		}
+	}
+	return fields, nil
+}
+
+func (d *decoder) document() (*Document, error) {
+	id, err := d.readBytes()
+	if err != nil {
+		return nil, err
+	}
+	fields, err := d.fields()
+	if err != nil {
+		return nil, err
+	}
+	return &Document{
+		ObjectID: id,
+		Fields:   fields,
+	}, nil
+}
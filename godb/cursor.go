@@ -0,0 +1,160 @@
+package godb
+
+import (
+	"errors"
+)
+
+var ErrNoDocument = errors.New("No current document")
+
+// how many candidates are checked between context checks
+const cursorCheckInterval = 256
+
+// Cursor iterates over the results of a query, matching documents as
+// it goes rather than up front:
+//
+//	c := db.Iter(godb.Q{"Age": godb.Gt(30)}, godb.FindOptions{})
+//	defer c.Close()
+//	for c.Next() {
+//		var d Doc
+//		c.Decode(&d)
+//	}
+//	if err := c.Err(); err != nil {
+//		...
+//	}
+//
+// The candidate documents are fixed when the cursor is created. Each
+// call to Next takes the read lock while it looks for the next match,
+// so writes can continue between calls; documents deleted since the
+// cursor was created are skipped.
+type Cursor struct {
+	db      *Database
+	fields  map[string]interface{}
+	opts    FindOptions
+	docs    []*Document
+	exact   bool
+	pos     int
+	matched int
+	count   int
+	doc     *Document
+	err     error
+	closed  bool
+}
+
+// Iter returns a cursor over the documents matching the query. A
+// sorted query without an ordered index on the sort fields is sorted
+// when the cursor is created.
+func (db *Database) Iter(query interface{}, opts FindOptions) *Cursor {
+	db.WriteLock.RLock()
+	defer db.WriteLock.RUnlock()
+
+	c := &Cursor{
+		db:     db,
+		fields: queryFields(query),
+		opts:   opts,
+	}
+
+	if len(opts.Sort) == 0 {
+		c.docs, c.exact = db.candidates(c.fields)
+		return c
+	}
+
+	if idx, r, ok := db.sortIndex(c.fields, opts.Sort); ok {
+		walk := idx.Tree.Walk
+		if opts.Sort[0].Desc {
+			walk = idx.Tree.WalkReverse
+		}
+		c.docs = make([]*Document, 0)
+		walk(r, func(l *Leaf) bool {
+			c.docs = append(c.docs, l.Documents...)
+			return true
+		})
+		return c
+	}
+
+	// the page is selected here, and the results needn't be matched
+	// again
+	_, c.docs = db.sorted(c.fields, opts, nil)
+	c.exact = true
+	c.opts.Start = 0
+	return c
+}
+
+// Next advances to the next matching document, returning false when
+// there are no more or the cursor's context is done.
+func (c *Cursor) Next() bool {
+	c.doc = nil
+	if c.closed || c.err != nil {
+		return false
+	}
+	if c.opts.Limit > 0 && c.count >= c.opts.Limit {
+		return false
+	}
+
+	c.db.WriteLock.RLock()
+	defer c.db.WriteLock.RUnlock()
+
+	for c.pos < len(c.docs) {
+		if c.opts.Context != nil && c.pos%cursorCheckInterval == 0 {
+			if err := c.opts.Context.Err(); err != nil {
+				c.err = err
+				return false
+			}
+		}
+
+		d := c.docs[c.pos]
+		c.pos++
+		if c.db.IDs[string(d.ObjectID)] != d {
+			continue
+		}
+
+		values := d.Values()
+		if !c.exact && !matchFields(d, values, c.fields) {
+			continue
+		}
+		c.matched++
+		if c.matched <= c.opts.Start {
+			continue
+		}
+
+		c.count++
+		c.doc = d
+		if c.opts.projected() {
+			c.doc = project(d, values, c.opts)
+		}
+		return true
+	}
+	return false
+}
+
+// Document returns the current document, or nil before Next is called
+// or once it returns false
+func (c *Cursor) Document() *Document {
+	return c.doc
+}
+
+// Decode unmarshals the current document into a struct pointer
+func (c *Cursor) Decode(value interface{}) error {
+	if c.doc == nil {
+		return ErrNoDocument
+	}
+
+	c.db.WriteLock.RLock()
+	defer c.db.WriteLock.RUnlock()
+
+	c.doc.Unmarshal(value)
+	return nil
+}
+
+// Err returns the error which stopped the cursor, if any
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// Close releases the cursor's candidates. Next returns false once the
+// cursor is closed.
+func (c *Cursor) Close() error {
+	c.closed = true
+	c.docs = nil
+	c.doc = nil
+	return nil
+}
@@ -0,0 +1,75 @@
+package godb
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+)
+
+func TestIter(t *testing.T) {
+	db := NewDatabase()
+	db.NewIndex("Name")
+	for i := 0; i < 1000; i++ {
+		db.Insert(&TestDoc{
+			Name: "Test document " + strconv.Itoa(i%100),
+			Age:  i,
+		})
+	}
+
+	c := db.Iter(Q{"Age": Gte(500)}, FindOptions{Start: 10, Limit: 20})
+	defer c.Close()
+	ages := make([]int, 0)
+	for c.Next() {
+		var d TestDoc
+		assert.Nil(t, c.Decode(&d), "no error decoding document")
+		ages = append(ages, d.Age)
+	}
+	assert.Nil(t, c.Err(), "no error iterating")
+	assert.Equal(t, len(ages), 20, "limit is respected")
+	assert.Equal(t, ages[0], 510, "start is respected")
+
+	c = db.Iter(Q{"Name": "Test document 5"}, FindOptions{})
+	n := 0
+	for c.Next() {
+		n++
+		if n == 1 {
+			// documents deleted while iterating are skipped
+			db.Delete(Q{"Name": "Test document 5", "Age": 905}, 0)
+		}
+	}
+	assert.Equal(t, n, 9, "9 documents iterated")
+	c.Close()
+	assert.False(t, c.Next(), "closed cursor has no documents")
+	assert.Equal(t, c.Decode(&TestDoc{}), ErrNoDocument)
+
+	c = db.Iter(nil, FindOptions{Sort: []SortField{Desc("Age")}, Limit: 3, Include: []string{"Age"}})
+	ages = make([]int, 0)
+	for c.Next() {
+		assert.Equal(t, len(c.Document().Fields), 1, "results are projected")
+		ages = append(ages, c.Document().Fields["Age"].(int))
+	}
+	assert.Equal(t, ages, []int{999, 998, 997}, "results are sorted")
+}
+
+func TestIterCancelled(t *testing.T) {
+	db := NewDatabase()
+	for i := 0; i < 1000; i++ {
+		db.Insert(&TestDoc{Name: "Test document " + strconv.Itoa(i), Age: i})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := db.Iter(nil, FindOptions{Context: ctx})
+	defer c.Close()
+
+	n := 0
+	for c.Next() {
+		n++
+		if n == 300 {
+			cancel()
+		}
+	}
+	assert.Equal(t, c.Err(), context.Canceled)
+	assert.True(t, n < 1000, "iteration stops when the context is cancelled")
+}
@@ -1,54 +1,158 @@
 package godb
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/ian-kent/go-log/log"
+	"reflect"
 	"sync"
 )
 
+var ErrNotFound = errors.New("Document not found")
+var ErrDuplicateID = errors.New("Document with ObjectID already exists")
+
 type Database struct {
 	Documents []*Document
 	DBLock    *sync.Mutex
-	WriteLock *sync.Mutex
+	WriteLock *sync.RWMutex
 	Indexes   map[string]*Index
+	IDs       map[string]*Document
+	WAL       *WAL
+	Storage   Storage
+
+	// struct types whose tagged indexes have been declared, guarded
+	// by DBLock
+	IndexedTypes map[reflect.Type]bool
 }
 
 func NewDatabase() Database {
 	return Database{
 		Documents: make([]*Document, 0),
 		Indexes:   make(map[string]*Index, 0),
+		IDs:       make(map[string]*Document),
 		DBLock:    new(sync.Mutex),
-		WriteLock: new(sync.Mutex),
+		WriteLock: new(sync.RWMutex),
+
+		IndexedTypes: make(map[reflect.Type]bool),
 	}
 }
 
-func (db *Database) NewIndexes(fields ...[]string) error {
-	db.DBLock.Lock()
-	defer db.DBLock.Unlock()
+// Open returns a database backed by the write-ahead log at path,
+// creating the log if it doesn't exist. If a snapshot was written by
+// Checkpoint it is loaded first, then the log is replayed on top of it
+// to rebuild the documents and indexes.
+func Open(path string) (*Database, error) {
+	db, generation, err := openSnapshot(snapshotPath(path))
+	if err != nil {
+		return nil, err
+	}
 
-	idxs, err := NewIndexes(db, fields...)
+	wal, err := OpenWAL(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.replay(wal, generation); err != nil {
+		wal.Close()
+		return nil, err
+	}
+	db.WAL = wal
 
+	return db, nil
+}
+
+// NewDatabaseWithStorage returns a database whose document bodies are
+// kept in s. Documents already in s are loaded as handles without
+// reading their fields; indexes must be recreated with NewIndex.
+func NewDatabaseWithStorage(s Storage) (*Database, error) {
+	db := NewDatabase()
+	db.Storage = s
+
+	err := s.Each(func(offset int64, id ObjectID) error {
+		doc := &Document{
+			ObjectID: id,
+			storage:  s,
+			offset:   offset,
+		}
+		db.Documents = append(db.Documents, doc)
+		db.IDs[string(id)] = doc
+		return nil
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	for _, idx := range idxs {
-		db.Indexes[idx.Name] = idx
+	return &db, nil
+}
+
+func (db *Database) Close() error {
+	if db.Storage != nil {
+		if err := db.Storage.Close(); err != nil {
+			return err
+		}
+	}
+	if db.WAL == nil {
+		return nil
 	}
+	return db.WAL.Close()
+}
 
-	return nil
+// NewIndexes builds and registers indexes on the given field lists.
+func (db *Database) NewIndexes(fields ...[]string) error {
+	idxs := make([]*Index, len(fields))
+	for i, fl := range fields {
+		idxs[i] = newIndex(db, fl)
+	}
+	return db.addIndexes(idxs...)
 }
 
 func (db *Database) NewIndex(fields ...string) error {
+	return db.NewIndexWithOptions(fields)
+}
+
+// NewIndexWithOptions builds and registers an index on the fields,
+// e.g. db.NewIndexWithOptions([]string{"Age"}, godb.Ordered())
+func (db *Database) NewIndexWithOptions(fields []string, opts ...IndexOption) error {
+	return db.addIndexes(newIndex(db, fields, opts...))
+}
+
+// addIndexes builds, logs and registers the indexes. Writes are blocked
+// while the indexes are built so that no document is missed.
+func (db *Database) addIndexes(idxs ...*Index) error {
 	db.DBLock.Lock()
 	defer db.DBLock.Unlock()
+	db.WriteLock.Lock()
+	defer db.WriteLock.Unlock()
 
-	idx, err := NewIndex(db, fields...)
+	return db.registerIndexes(idxs...)
+}
 
-	if err != nil {
+// registerIndexes is addIndexes for a caller holding DBLock and the
+// write lock
+func (db *Database) registerIndexes(idxs ...*Index) error {
+	if err := buildIndexes(db, idxs...); err != nil {
 		return err
 	}
 
-	db.Indexes[idx.Name] = idx
+	if db.WAL != nil {
+		recs := make([][]byte, len(idxs))
+		for i, idx := range idxs {
+			rec, err := encodeNewIndex(idx)
+			if err != nil {
+				return err
+			}
+			recs[i] = rec
+		}
+		if err := db.WAL.Append(recs...); err != nil {
+			return err
+		}
+	}
+
+	for _, idx := range idxs {
+		db.Indexes[idx.Name] = idx
+	}
 
 	return nil
 }
@@ -58,6 +162,14 @@ func (db *Database) GetIndex(fields ...string) *Index {
 	return idx
 }
 
+// FindByID returns the document with the given ObjectID, or nil
+func (db *Database) FindByID(id ObjectID) *Document {
+	db.WriteLock.RLock()
+	defer db.WriteLock.RUnlock()
+
+	return db.findByID(id)
+}
+
 func (db *Database) FindOne(query interface{}, start int) *Document {
 	n, docs := db.Find(query, start, 1)
 	if n == 0 {
@@ -66,62 +178,77 @@ func (db *Database) FindOne(query interface{}, start int) *Document {
 	return docs[0]
 }
 
+// FindOptions controls the results returned by FindWithOptions
+type FindOptions struct {
+	// Start skips the first Start results
+	Start int
+	// Limit is the maximum number of results, 0 for all of them
+	Limit int
+	// Sort orders the results by the fields in turn. Results are in
+	// index or insertion order if it's empty.
+	Sort []SortField
+	// Include limits the fields of the results to those listed
+	Include []string
+	// Exclude removes the listed fields from the results
+	Exclude []string
+	// Context stops a Cursor's scan when it's done
+	Context context.Context
+}
+
+// Find returns the number of documents matching the query and up to
+// limit of them, skipping the first start. A limit of 0 returns all of
+// them.
 func (db *Database) Find(query interface{}, start int, limit int) (int, []*Document) {
-	fields := GetFields(query)
+	return db.FindWithOptions(query, FindOptions{Start: start, Limit: limit})
+}
+
+// FindWithOptions returns the number of documents matching the query
+// and the results selected by opts.
+func (db *Database) FindWithOptions(query interface{}, opts FindOptions) (int, []*Document) {
+	db.WriteLock.RLock()
+	defer db.WriteLock.RUnlock()
+
+	return db.findWithPlan(queryFields(query), opts, nil)
+}
+
+// findWithPlan runs a query, recording how in p if it isn't nil. The
+// caller must hold a lock.
+func (db *Database) findWithPlan(fields map[string]interface{}, opts FindOptions, p *Plan) (int, []*Document) {
 	log.Trace("Query: %s", fields)
 
-	f := make([]string, 0)
-	for fn, _ := range fields {
-		f = append(f, fn)
-	}
-	if len(f) > 0 {
-		//log.Trace("Query has %d fields", len(f))
-		if idx := db.GetIndex(f...); idx != nil {
-			//log.Trace("Using index %s", idx.Name);
-			l := idx.FindLeaf(fields)
-			if l == nil {
-				//log.Trace("Leaf not found")
-				return 0, make([]*Document, 0)
-			}
-			//log.Trace("Leaf: %s", l.GetHash())
-			if len(l.Documents) == 0 {
-				//log.Trace("Leaf contains no documents")
-				return 0, make([]*Document, 0)
-			}
-			mc := len(l.Documents)
-			if start > mc-1 {
-				//log.Trace("Leaf contains documents, but start index too high")
-				return mc, make([]*Document, 0)
-			}
-			if start <= mc-1 && start+limit < mc-1 {
-				//log.Trace("Leaf contains enough documents to satisfy range: %d:%d", start, start + limit - 1)
-				return mc, l.Documents[start : start+limit-1]
-			}
-			//log.Trace("Leaf has subset of documents in range")
-			return mc, l.Documents[start:]
-		} else {
-			//log.Trace("Index not found")
-		}
-	} // else {
-	//log.Trace("No fields in query")
-	//}
+	if idx, r, ok := db.coveringIndex(fields, opts); ok {
+		return db.covered(idx, r, fields, opts, p)
+	}
 
-	log.Trace("Scanning full database")
+	n, docs := db.find(fields, opts, p)
+	if !opts.projected() {
+		return n, docs
+	}
+	// docs may share an index or the database's backing array
+	projected := make([]*Document, len(docs))
+	for i, d := range docs {
+		projected[i] = project(d, d.Values(), opts)
+	}
+	return n, projected
+}
+
+func (db *Database) find(fields map[string]interface{}, opts FindOptions, p *Plan) (int, []*Document) {
+	if len(opts.Sort) > 0 {
+		return db.sorted(fields, opts, p)
+	}
+
+	docs, exact := db.plannedCandidates(fields, p)
+	if exact {
+		return len(docs), page(docs, opts.Start, opts.Limit)
+	}
 
 	results := make([]*Document, 0)
 
 	mc := 0
-	for _, d := range db.Documents {
-		match := true
-		for fn, f := range fields {
-			//log.Info("Checking for [%s] in field [%s] with value [%s]", f.Value, f.Name, d.Fields[f.Name].Value)
-			if d.Fields[fn] != f {
-				match = false
-				break
-			}
-		}
-		if match {
-			if mc >= start && len(results) <= limit {
+	for _, d := range docs {
+		p.examined()
+		if matchDocument(d, fields) {
+			if mc >= opts.Start && (opts.Limit <= 0 || len(results) < opts.Limit) {
 				results = append(results, d)
 			}
 			mc++
@@ -130,21 +257,532 @@ func (db *Database) Find(query interface{}, start int, limit int) (int, []*Docum
 	return mc, results
 }
 
-func (db *Database) Insert(obj ...interface{}) (int, []*Document) {
+// Count returns the number of documents matching the query without
+// building a list of them. It's answered from an index where the query
+// only reads indexed fields.
+func (db *Database) Count(query interface{}) int {
+	db.WriteLock.RLock()
+	defer db.WriteLock.RUnlock()
+
+	fields := queryFields(query)
+	docs, exact := db.candidates(fields)
+	if exact {
+		return len(docs)
+	}
+
+	// a hashed index's leaves are only worth walking instead of a scan
+	if names := queryFieldNames(fields); indexOf(names, idField) < 0 {
+		idx := db.indexCovering(fields, names...)
+		if idx != nil && (idx.Ordered || len(docs) == len(db.Documents)) {
+			log.Trace("Counting from index %s", idx.Name)
+			n := 0
+			idx.eachValue(fields, func(_ *Leaf, docs []*Document, _ map[string]interface{}) {
+				n += len(docs)
+			})
+			return n
+		}
+	}
+
+	n := 0
+	for _, d := range docs {
+		if matchDocument(d, fields) {
+			n++
+		}
+	}
+	return n
+}
+
+// EstimatedCount returns the number of documents in the database
+// without evaluating a query
+func (db *Database) EstimatedCount() int {
+	db.WriteLock.RLock()
+	defer db.WriteLock.RUnlock()
+
+	return len(db.Documents)
+}
+
+// page returns the documents from start, up to limit of them
+func page(docs []*Document, start int, limit int) []*Document {
+	if start >= len(docs) {
+		return make([]*Document, 0)
+	}
+	docs = docs[start:]
+	if limit > 0 && limit < len(docs) {
+		docs = docs[:limit]
+	}
+	return docs
+}
+
+// matchDocument reports whether the document matches every query field
+func matchDocument(d *Document, fields map[string]interface{}) bool {
+	return matchFields(d, d.Values(), fields)
+}
+
+// matching returns up to limit documents matching the query fields, or
+// all of them if limit is 0. The caller must hold the write lock.
+func (db *Database) matching(fields map[string]interface{}, limit int) []*Document {
+	candidates, _ := db.candidates(fields)
+
+	docs := make([]*Document, 0)
+	for _, d := range candidates {
+		if limit > 0 && len(docs) >= limit {
+			break
+		}
+		if matchDocument(d, fields) {
+			docs = append(docs, d)
+		}
+	}
+	return docs
+}
+
+// Delete removes up to limit documents matching the query, or all of
+// them if limit is 0, and returns the number removed.
+func (db *Database) Delete(query interface{}, limit int) (int, error) {
+	db.WriteLock.Lock()
+	defer db.WriteLock.Unlock()
+
+	docs := db.matching(queryFields(query), limit)
+	if len(docs) == 0 {
+		return 0, nil
+	}
+
+	if db.WAL != nil {
+		if err := db.WAL.Append(encodeDelete(docs)); err != nil {
+			return 0, err
+		}
+	}
+
+	if db.Storage != nil {
+		for _, doc := range docs {
+			if err := db.Storage.Delete(doc.offset); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	db.remove(docs)
+	return len(docs), nil
+}
+
+// remove drops the documents from the database and its indexes. The
+// caller must hold the write lock.
+func (db *Database) remove(docs []*Document) {
+	set := make(map[*Document]bool, len(docs))
+	for _, doc := range docs {
+		set[doc] = true
+		delete(db.IDs, string(doc.ObjectID))
+	}
+
+	for _, idx := range db.Indexes {
+		idx.Remove(docs...)
+	}
+
+	// build a new slice, Find may be reading the old one
+	remaining := make([]*Document, 0, len(db.Documents))
+	for _, doc := range db.Documents {
+		if !set[doc] {
+			remaining = append(remaining, doc)
+		}
+	}
+	db.Documents = remaining
+}
+
+// Update sets the fields in changes on every document matching the
+// query and returns the number of documents updated. Documents are moved
+// between index leaves when an indexed field changes.
+func (db *Database) Update(query interface{}, changes interface{}) (int, error) {
+	db.WriteLock.Lock()
+	defer db.WriteLock.Unlock()
+
+	docs := db.matching(queryFields(query), 0)
+	if len(docs) == 0 {
+		return 0, nil
+	}
+
+	cf, err := storedFields(changes)
+	if err != nil {
+		return 0, err
+	}
+	updated := make([]*Document, len(docs))
+	for i, doc := range docs {
+		fields := make(map[string]interface{})
+		for fn, v := range doc.Values() {
+			fields[fn] = v
+		}
+		for fn, v := range cf {
+			fields[fn] = v
+		}
+		updated[i] = &Document{
+			ObjectID: doc.ObjectID,
+			Fields:   fields,
+		}
+	}
+
+	if err := db.replace(docs, updated); err != nil {
+		return 0, err
+	}
+	return len(docs), nil
+}
+
+// Upsert replaces the first document matching the query with obj, or
+// inserts obj if nothing matches. The lookup and write happen under the
+// write lock, so concurrent upserts of the same query can't both insert.
+func (db *Database) Upsert(query interface{}, obj interface{}) (inserted bool, doc *Document, err error) {
+	if err := db.declareIndexes(obj); err != nil {
+		return false, nil, err
+	}
+
+	db.WriteLock.Lock()
+	defer db.WriteLock.Unlock()
+
+	if docs := db.matching(queryFields(query), 1); len(docs) > 0 {
+		fields, err := storedFields(obj)
+		if err != nil {
+			return false, nil, err
+		}
+		updated := &Document{
+			ObjectID: docs[0].ObjectID,
+			Fields:   fields,
+		}
+		if err := db.replace(docs, []*Document{updated}); err != nil {
+			return false, nil, err
+		}
+		return false, docs[0], nil
+	}
+
+	_, docs, err := db.insertObjects(AllOrNothing, obj)
+	if err != nil {
+		return false, nil, err
+	}
+	return true, docs[0], nil
+}
+
+// Replace replaces all fields of the document with the given ObjectID
+func (db *Database) Replace(id ObjectID, obj interface{}) error {
 	db.WriteLock.Lock()
 	defer db.WriteLock.Unlock()
 
+	doc := db.findByID(id)
+	if doc == nil {
+		return ErrNotFound
+	}
+
+	fields, err := storedFields(obj)
+	if err != nil {
+		return err
+	}
+	updated := &Document{
+		ObjectID: doc.ObjectID,
+		Fields:   fields,
+	}
+	return db.replace([]*Document{doc}, []*Document{updated})
+}
+
+// findByID returns the document with the given ObjectID. The caller
+// must hold the write lock.
+func (db *Database) findByID(id ObjectID) *Document {
+	return db.IDs[string(id)]
+}
+
+// replace gives each document the fields of its counterpart in updated,
+// writing the new versions to the log and storage first. The caller
+// must hold the write lock.
+func (db *Database) replace(docs []*Document, updated []*Document) error {
+	keys := make(uniqueKeys)
+	unique := db.uniqueIndexes()
+	for i, doc := range docs {
+		if err := keys.claim(unique, doc.ObjectID, doc, updated[i].Fields); err != nil {
+			return err
+		}
+	}
+
+	if db.WAL != nil {
+		recs := make([][]byte, len(updated))
+		for i, doc := range updated {
+			rec, err := encodeReplace(doc)
+			if err != nil {
+				return err
+			}
+			recs[i] = rec
+		}
+		if err := db.WAL.Append(recs...); err != nil {
+			return err
+		}
+	}
+
+	for i, doc := range docs {
+		if doc.storage != nil {
+			offset, err := db.Storage.Put(doc.ObjectID, updated[i].Fields)
+			if err != nil {
+				return err
+			}
+			if err := db.Storage.Delete(doc.offset); err != nil {
+				return err
+			}
+			// hold the old fields in memory until they're unindexed
+			doc.Fields = doc.Values()
+			doc.offset = offset
+		}
+		db.update(doc, updated[i].Fields)
+	}
+
+	return nil
+}
+
+// update sets the document's fields and re-indexes it in any index
+// whose key has changed. The caller must hold the write lock.
+func (db *Database) update(doc *Document, fields map[string]interface{}) {
+	changed := make([]*Index, 0)
+	updated := &Document{ObjectID: doc.ObjectID, Fields: fields}
+	for _, idx := range db.Indexes {
+		was, is := idx.includes(doc, doc.Values()), idx.includes(updated, fields)
+		if was == is && (!was || sameKeys(idx, doc.Values(), fields)) {
+			continue
+		}
+		if was {
+			idx.Remove(doc)
+		}
+		changed = append(changed, idx)
+	}
+
+	// swap the map rather than modifying it, Find may be reading it
+	doc.Fields = fields
+	for _, idx := range changed {
+		idx.Index(doc)
+	}
+	if doc.storage != nil {
+		doc.Fields = nil
+	}
+}
+
+// sameKeys reports whether two sets of values have the same keys in idx
+func sameKeys(idx *Index, a, b map[string]interface{}) bool {
+	ka, _ := idx.docKeys(a)
+	kb, _ := idx.docKeys(b)
+	if len(ka) != len(kb) {
+		return false
+	}
+	for i := range ka {
+		if !bytes.Equal(ka[i], kb[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Insert adds the objects to the database, each a struct pointer, a
+// map[string]interface{} or a JSON object. If the database has a
+// write-ahead log the documents are logged before they become visible.
+// If any object can't be inserted none are.
+func (db *Database) Insert(obj ...interface{}) (int, []*Document, error) {
+	return db.InsertBatch(AllOrNothing, obj...)
+}
+
+// BatchMode selects what InsertBatch does when some of its documents
+// can't be inserted
+type BatchMode int
+
+const (
+	// AllOrNothing inserts none of the documents and returns the first
+	// error
+	AllOrNothing BatchMode = iota
+	// Partial inserts the documents which can be, and returns a
+	// *BatchError for the rest
+	Partial
+)
+
+// BatchError holds the error for each object of a Partial batch insert
+// which wasn't inserted, by its position in the batch
+type BatchError struct {
+	Errors map[int]error
+}
+
+func (e *BatchError) Error() string {
+	first := -1
+	for i := range e.Errors {
+		if first < 0 || i < first {
+			first = i
+		}
+	}
+	return fmt.Sprintf("%d documents not inserted, first at %d: %s", len(e.Errors), first, e.Errors[first])
+}
+
+// InsertBatch is Insert with a choice of what happens to a batch when
+// some of its objects fail, e.g. with an ErrDuplicateKey. The inserted
+// documents are returned.
+func (db *Database) InsertBatch(mode BatchMode, obj ...interface{}) (int, []*Document, error) {
+	if err := db.declareIndexes(obj...); err != nil {
+		return 0, nil, err
+	}
+
+	db.WriteLock.Lock()
+	defer db.WriteLock.Unlock()
+
+	return db.insertObjects(mode, obj...)
+}
+
+// declareIndexes creates the indexes declared by the godb tags of each
+// object's type, the first time the type is seen. A type is only marked
+// as seen once all its indexes exist, so a failed declaration is retried
+// by the next insert, and DBLock is held throughout so a concurrent
+// insert of the type waits for them. An existing index on a unique
+// field must be unique too, or ErrIndexOptionsConflict is returned.
+func (db *Database) declareIndexes(obj ...interface{}) error {
+	db.DBLock.Lock()
+	defer db.DBLock.Unlock()
+
+	for _, o := range obj {
+		tp := reflect.TypeOf(o)
+		if tp == nil || tp.Kind() != reflect.Ptr || tp.Elem().Kind() != reflect.Struct || db.IndexedTypes[tp] {
+			// only structs declare indexes
+			continue
+		}
+		for _, f := range GetFieldNames(o) {
+			if !f.Indexed || f.Field.Type == objectIDType {
+				continue
+			}
+			opts := make([]IndexOption, 0)
+			if f.Unique {
+				opts = append(opts, Unique())
+			}
+			idx := newIndex(db, []string{f.Key}, opts...)
+			db.WriteLock.Lock()
+			err := db.registerIndexes(idx)
+			db.WriteLock.Unlock()
+			if err == ErrIndexAlreadyExists {
+				// an existing index must enforce a unique tag for
+				// every document
+				if existing := db.Indexes[idx.Name]; f.Unique && (!existing.Unique || existing.Filter != nil) {
+					return ErrIndexOptionsConflict
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			log.Trace("Created declared index on %s", f.Key)
+		}
+		db.IndexedTypes[tp] = true
+	}
+	return nil
+}
+
+// insertObjects marshals, logs, stores and indexes the objects. The
+// caller must hold the write lock.
+func (db *Database) insertObjects(mode BatchMode, obj ...interface{}) (int, []*Document, error) {
+	docs := make([]*Document, 0, len(obj))
+	recs := make([][]byte, 0, len(obj))
+	ids := make(map[string]bool, len(obj))
+	keys := make(uniqueKeys)
+	unique := db.uniqueIndexes()
+	failed := make(map[int]error)
+	for i, o := range obj {
+		doc, rec, err := db.prepareInsert(o, ids, unique, keys)
+		if err != nil {
+			if mode == AllOrNothing {
+				return 0, nil, err
+			}
+			failed[i] = err
+			continue
+		}
+		ids[string(doc.ObjectID)] = true
+		docs = append(docs, doc)
+		recs = append(recs, rec)
+	}
+
+	if db.WAL != nil && len(recs) > 0 {
+		if err := db.WAL.Append(recs...); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if db.Storage != nil {
+		for i, doc := range docs {
+			if err := db.store(doc); err != nil {
+				db.abortInsert(docs, i)
+				return 0, nil, err
+			}
+		}
+	}
+
+	docs = db.insert(docs...)
+	if len(failed) > 0 {
+		return len(docs), docs, &BatchError{Errors: failed}
+	}
+	return len(docs), docs, nil
+}
+
+// prepareInsert marshals an object and checks it can be inserted, with
+// its log record if the database has a write-ahead log. ids and keys
+// hold the ObjectIDs and unique values of the documents before it in
+// the batch.
+func (db *Database) prepareInsert(o interface{}, ids map[string]bool, unique []*Index, keys uniqueKeys) (*Document, []byte, error) {
+	doc, err := marshal(o)
+	if err != nil {
+		return nil, nil, err
+	}
+	id := string(doc.ObjectID)
+	if _, ok := db.IDs[id]; ok || ids[id] {
+		return nil, nil, ErrDuplicateID
+	}
+	if err := keys.claim(unique, doc.ObjectID, nil, doc.Fields); err != nil {
+		return nil, nil, err
+	}
+
+	var rec []byte
+	if db.WAL != nil {
+		if rec, err = encodeInsert(doc); err != nil {
+			return nil, nil, err
+		}
+	}
+	return doc, rec, nil
+}
+
+// store writes the document body to the database storage. The fields
+// stay in memory until the document has been indexed.
+func (db *Database) store(doc *Document) error {
+	offset, err := db.Storage.Put(doc.ObjectID, doc.Fields)
+	if err != nil {
+		return err
+	}
+	doc.storage = db.Storage
+	doc.offset = offset
+	return nil
+}
+
+// abortInsert rolls back an insert whose documents were logged but
+// only the first stored of them written to storage, so that they don't
+// come back when the storage is reopened or the log replayed
+func (db *Database) abortInsert(docs []*Document, stored int) {
+	for _, doc := range docs[:stored] {
+		if err := db.Storage.Delete(doc.offset); err != nil {
+			log.Error("Failed to remove stored document %s: %s", doc.ObjectID.Hex(), err)
+		}
+		doc.storage = nil
+	}
+	if db.WAL != nil {
+		if err := db.WAL.Append(encodeDelete(docs)); err != nil {
+			log.Error("Failed to log removal of %d documents: %s", len(docs), err)
+		}
+	}
+}
+
+// insert adds already marshalled documents to the database and its
+// indexes. The caller must hold the write lock.
+func (db *Database) insert(docs ...*Document) []*Document {
 	sindex := len(db.Documents)
-	db.Documents = append(db.Documents, make([]*Document, len(obj), len(obj))...)
+	db.Documents = append(db.Documents, docs...)
 	eindex := len(db.Documents)
 
-	for i, o := range obj {
-		doc := Marshal(o)
-		db.Documents[sindex+i] = doc
+	for _, doc := range docs {
+		db.IDs[string(doc.ObjectID)] = doc
 		for _, idx := range db.Indexes {
 			idx.Index(doc)
 		}
+		if doc.storage != nil {
+			doc.Fields = nil
+		}
 	}
 
-	return eindex - sindex, db.Documents[sindex:eindex]
+	return db.Documents[sindex:eindex]
 }
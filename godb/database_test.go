@@ -1,6 +1,7 @@
 package godb
 
 import (
+	"encoding/json"
 	"github.com/stretchr/testify/assert"
 	"math/rand"
 	"strconv"
@@ -37,7 +38,7 @@ func TestInsert(t *testing.T) {
 			Name: "Test document " + strconv.Itoa(i),
 			Age:  age,
 		}
-		n, _ := db.Insert(doc)
+		n, _, _ := db.Insert(doc)
 		docs += n
 	}
 
@@ -75,7 +76,7 @@ func TestBatchInsert(t *testing.T) {
 		batch[i] = doc
 	}
 
-	docs, _ := db.Insert(batch...)
+	docs, _, _ := db.Insert(batch...)
 
 	assert.Equal(t, docs, 1000, "insert return value correct")
 	assert.Equal(t, len(db.Documents), 1000, "db contains 1000 documents")
@@ -153,7 +154,7 @@ func TestFind(t *testing.T) {
 			Name: "Test document " + strconv.Itoa(i),
 			Age:  age,
 		}
-		n, _ := db.Insert(doc)
+		n, _, _ := db.Insert(doc)
 		dn += n
 	}
 
@@ -173,6 +174,41 @@ func TestFind(t *testing.T) {
 	assert.Equal(t, d.Name, "Test document 500")
 }
 
+func TestFindPaging(t *testing.T) {
+	db := NewDatabase()
+	db.NewIndex("Age")
+
+	for i := 0; i < 100; i++ {
+		db.Insert(&TestDoc{
+			Name: "Test document " + strconv.Itoa(i),
+			Age:  i % 2,
+		})
+	}
+
+	for _, query := range []interface{}{
+		&struct{ Age int }{Age: 1},
+		&struct{ Name Q }{Name: Prefix("Test")},
+	} {
+		n, docs := db.Find(query, 0, 10)
+		assert.Equal(t, len(docs), 10, "limit is respected")
+		first := docs[0]
+
+		n2, docs := db.Find(query, 10, 10)
+		assert.Equal(t, n2, n, "count is independent of paging")
+		assert.Equal(t, len(docs), 10, "second page is full")
+		assert.NotEqual(t, docs[0], first, "second page starts after the first")
+
+		_, docs = db.Find(query, n-5, 10)
+		assert.Equal(t, len(docs), 5, "last page is partial")
+
+		_, docs = db.Find(query, n, 10)
+		assert.Equal(t, len(docs), 0, "no results past the end")
+
+		_, docs = db.Find(query, 0, 0)
+		assert.Equal(t, len(docs), n, "a limit of 0 returns everything")
+	}
+}
+
 func TestFindOne(t *testing.T) {
 	db := NewDatabase()
 
@@ -186,7 +222,7 @@ func TestFindOne(t *testing.T) {
 			Name: "Test document " + strconv.Itoa(i),
 			Age:  age,
 		}
-		n, _ := db.Insert(doc)
+		n, _, _ := db.Insert(doc)
 		dn += n
 	}
 
@@ -204,6 +240,229 @@ func TestFindOne(t *testing.T) {
 	assert.Equal(t, d.Name, "Test document 500")
 }
 
+func TestDelete(t *testing.T) {
+	db := NewDatabase()
+	db.NewIndex("Name")
+	db.NewIndex("Age")
+
+	for i := 0; i < 1000; i++ {
+		db.Insert(&TestDoc{
+			Name: "Test document " + strconv.Itoa(i),
+			Age:  i % 10,
+		})
+	}
+
+	n, err := db.Delete(&struct{ Name string }{Name: "Test document 1234"}, 0)
+	assert.Nil(t, err, "no error deleting")
+	assert.Equal(t, n, 0, "nothing deleted for invalid name")
+
+	n, err = db.Delete(&struct{ Name string }{Name: "Test document 500"}, 0)
+	assert.Nil(t, err, "no error deleting")
+	assert.Equal(t, n, 1, "1 document deleted")
+	assert.Equal(t, len(db.Documents), 999, "db contains 999 documents")
+	assert.Nil(t, db.FindOne(&struct{ Name string }{Name: "Test document 500"}, 0), "deleted document not found")
+	assert.Equal(t, db.GetIndex("Name").Count, 999, "name index contains 999 documents")
+	assert.Equal(t, db.GetIndex("Age").Count, 999, "age index contains 999 documents")
+
+	n, err = db.Delete(&struct{ Age int }{Age: 3}, 10)
+	assert.Nil(t, err, "no error deleting")
+	assert.Equal(t, n, 10, "delete honours limit")
+	c, _ := db.Find(&struct{ Age int }{Age: 3}, 0, 10)
+	assert.Equal(t, c, 90, "90 documents remain")
+
+	// no index on both fields, so this scans
+	n, err = db.Delete(&struct {
+		Name string
+		Age  int
+	}{Name: "Test document 501", Age: 1}, 0)
+	assert.Nil(t, err, "no error deleting")
+	assert.Equal(t, n, 1, "1 document deleted by scan")
+	assert.Nil(t, db.FindOne(&struct{ Name string }{Name: "Test document 501"}, 0), "deleted document not found")
+
+	n, err = db.Delete(&struct{}{}, 0)
+	assert.Nil(t, err, "no error deleting")
+	assert.Equal(t, n, 988, "all remaining documents deleted")
+	assert.Equal(t, len(db.Documents), 0, "db contains 0 documents")
+	assert.Equal(t, db.GetIndex("Name").Count, 0, "name index is empty")
+	assert.Equal(t, len(db.GetIndex("Name").Tree.Children), 0, "empty leaves are pruned")
+	assert.Equal(t, len(db.GetIndex("Age").Tree.Children), 0, "empty leaves are pruned")
+
+	db.Insert(&TestDoc{Name: "Test document 500", Age: 5})
+	assert.NotNil(t, db.FindOne(&struct{ Name string }{Name: "Test document 500"}, 0), "index reusable after delete")
+}
+
+func TestUpdate(t *testing.T) {
+	db := NewDatabase()
+	db.NewIndex("Age")
+	db.NewIndex("Name", "Age")
+
+	for i := 0; i < 100; i++ {
+		db.Insert(&TestDoc{
+			Name: "Test document " + strconv.Itoa(i),
+			Age:  i % 10,
+		})
+	}
+
+	n, err := db.Update(&struct{ Age int }{Age: 3}, &struct{ Age int }{Age: 30})
+	assert.Nil(t, err, "no error updating")
+	assert.Equal(t, n, 10, "10 documents updated")
+
+	c, _ := db.Find(&struct{ Age int }{Age: 3}, 0, 10)
+	assert.Equal(t, c, 0, "documents moved out of old leaf")
+	c, docs := db.Find(&struct{ Age int }{Age: 30}, 0, 20)
+	assert.Equal(t, c, 10, "documents moved into new leaf")
+	assert.Equal(t, len(docs), 10)
+
+	doc := db.FindOne(&struct {
+		Name string
+		Age  int
+	}{Name: "Test document 13", Age: 30}, 0)
+	if assert.NotNil(t, doc, "compound index updated") {
+		var d TestDoc
+		doc.Unmarshal(&d)
+		assert.Equal(t, d.Name, "Test document 13", "unchanged fields are kept")
+	}
+	assert.Equal(t, db.GetIndex("Age").Count, 100, "index count unchanged")
+
+	n, err = db.Update(&struct{ Age int }{Age: 99}, &struct{ Age int }{Age: 1})
+	assert.Nil(t, err, "no error updating")
+	assert.Equal(t, n, 0, "nothing updated for invalid age")
+}
+
+func TestReplace(t *testing.T) {
+	db := NewDatabase()
+	db.NewIndex("Name")
+
+	_, docs, _ := db.Insert(&TestDoc{Name: "Test document 1", Age: 1})
+	id := docs[0].ObjectID
+
+	err := db.Replace(id, &TestDoc{Name: "Test document 2", Age: 2})
+	assert.Nil(t, err, "no error replacing")
+	assert.Nil(t, db.FindOne(&struct{ Name string }{Name: "Test document 1"}, 0), "old value not found")
+
+	doc := db.FindOne(&struct{ Name string }{Name: "Test document 2"}, 0)
+	if assert.NotNil(t, doc, "new value found") {
+		assert.Equal(t, doc.ObjectID, id, "object id unchanged")
+		var d TestDoc
+		doc.Unmarshal(&d)
+		assert.Equal(t, d.Age, 2)
+	}
+
+	err = db.Replace(NewObjectID(), &TestDoc{})
+	assert.Equal(t, err, ErrNotFound)
+}
+
+func TestUpsert(t *testing.T) {
+	db := NewDatabase()
+	db.NewIndex("Name")
+
+	inserted, doc, err := db.Upsert(&struct{ Name string }{Name: "Test document 1"}, &TestDoc{Name: "Test document 1", Age: 1})
+	assert.Nil(t, err, "no error upserting")
+	assert.True(t, inserted, "document inserted")
+	id := doc.ObjectID
+
+	inserted, doc, err = db.Upsert(&struct{ Name string }{Name: "Test document 1"}, &TestDoc{Name: "Test document 1", Age: 2})
+	assert.Nil(t, err, "no error upserting")
+	assert.False(t, inserted, "document replaced")
+	assert.Equal(t, doc.ObjectID, id, "existing document returned")
+	assert.Equal(t, len(db.Documents), 1, "db contains 1 document")
+
+	var d TestDoc
+	db.FindOne(&struct{ Name string }{Name: "Test document 1"}, 0).Unmarshal(&d)
+	assert.Equal(t, d.Age, 2, "document updated")
+}
+
+func TestConcurrentUpsert(t *testing.T) {
+	db := NewDatabase()
+	db.NewIndex("Name")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := "Test document " + strconv.Itoa(i%5)
+			db.Upsert(&struct{ Name string }{Name: name}, &TestDoc{Name: name, Age: i})
+			db.Find(&struct{ Name string }{Name: name}, 0, 10)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, len(db.Documents), 5, "each query inserted once")
+	assert.Equal(t, db.GetIndex("Name").Count, 5, "index contains 5 documents")
+}
+
+type TestDocWithID struct {
+	ID   ObjectID
+	Name string
+	Age  int
+}
+
+func TestFindByID(t *testing.T) {
+	db := NewDatabase()
+
+	for i := 0; i < 1000; i++ {
+		db.Insert(&TestDoc{
+			Name: "Test document " + strconv.Itoa(i),
+			Age:  i,
+		})
+	}
+
+	id := db.Documents[500].ObjectID
+	doc := db.FindByID(id)
+	if assert.NotNil(t, doc, "result for valid id") {
+		var d TestDoc
+		doc.Unmarshal(&d)
+		assert.Equal(t, d.Name, "Test document 500")
+	}
+	assert.Nil(t, db.FindByID(NewObjectID()), "no result for invalid id")
+
+	db.Delete(&struct{ Age int }{Age: 500}, 0)
+	assert.Nil(t, db.FindByID(id), "no result for deleted id")
+}
+
+func TestObjectIDRoundTrip(t *testing.T) {
+	db := NewDatabase()
+
+	_, docs, err := db.Insert(&TestDocWithID{Name: "Test document 1", Age: 1})
+	assert.Nil(t, err, "no error inserting")
+	id := docs[0].ObjectID
+	assert.NotEmpty(t, id, "object id generated")
+	_, ok := docs[0].Fields[idField]
+	assert.False(t, ok, "object id not stored as a field")
+
+	var d TestDocWithID
+	db.FindByID(id).Unmarshal(&d)
+	assert.Equal(t, d.ID, id, "object id unmarshalled")
+	assert.Equal(t, d.Name, "Test document 1")
+
+	d.Age = 2
+	_, _, err = db.Insert(&d)
+	assert.Equal(t, err, ErrDuplicateID, "can't insert existing object id")
+
+	err = db.Replace(d.ID, &d)
+	assert.Nil(t, err, "no error replacing")
+
+	n, found := db.Find(&struct{ ID ObjectID }{ID: id}, 0, 10)
+	assert.Equal(t, n, 1, "found by object id field")
+	if assert.Len(t, found, 1) {
+		var d2 TestDocWithID
+		found[0].Unmarshal(&d2)
+		assert.Equal(t, d2.Age, 2, "document replaced")
+	}
+
+	n, _ = db.Find(&struct {
+		ID  ObjectID
+		Age int
+	}{ID: id, Age: 1}, 0, 10)
+	assert.Equal(t, n, 0, "other query fields still apply")
+
+	db2 := NewDatabase()
+	_, docs, err = db2.Insert(&d)
+	assert.Nil(t, err, "no error inserting into another database")
+	assert.Equal(t, docs[0].ObjectID, id, "object id kept on insert")
+}
+
 func BenchmarkInsert(b *testing.B) {
 	db := NewDatabase()
 	for i := 0; i < b.N; i++ {
@@ -305,3 +564,144 @@ func BenchmarkIndexedBatchInsert(b *testing.B) {
 	}
 	wg.Wait()
 }
+
+func TestCount(t *testing.T) {
+	db := NewDatabase()
+	db.NewIndex("Name")
+	db.NewIndexWithOptions([]string{"Age"}, Ordered())
+
+	for i := 0; i < 1000; i++ {
+		db.Insert(&TestDoc{
+			Name: "Test document " + strconv.Itoa(i%100),
+			Age:  i % 60,
+		})
+	}
+
+	assert.Equal(t, db.EstimatedCount(), 1000, "database contains 1000 documents")
+	assert.Equal(t, db.Count(nil), 1000, "empty query counts every document")
+	assert.Equal(t, db.Count(&struct{ Name string }{Name: "Test document 5"}), 10, "count from index leaf")
+	assert.Equal(t, db.Count(Q{"Age": Gt(50)}), 144, "count from ordered index")
+	assert.Equal(t, db.Count(Q{"Name": In("Test document 1", "Test document 2")}), 20, "count from index lookups")
+	assert.Equal(t, db.Count(Q{"Name": Prefix("Test document 1"), "Age": 1}), 4, "count from a scan")
+
+	db.Delete(Q{"Age": Gt(50)}, 0)
+	assert.Equal(t, db.EstimatedCount(), 856, "estimated count follows deletes")
+	assert.Equal(t, db.Count(Q{"Age": Gt(50)}), 0, "count follows deletes")
+}
+
+func TestCountMissingFields(t *testing.T) {
+	for _, opts := range [][]IndexOption{nil, {Ordered()}} {
+		scan := NewDatabase()
+		indexed := NewDatabase()
+		indexed.NewIndexWithOptions([]string{"Nick"}, opts...)
+		for i := 0; i < 100; i++ {
+			doc := map[string]interface{}{"Name": "Test person " + strconv.Itoa(i)}
+			switch i % 4 {
+			case 1:
+				doc["Nick"] = nil
+			case 2, 3:
+				doc["Nick"] = "Nick " + strconv.Itoa(i%3)
+			}
+			scan.Insert(doc)
+			indexed.Insert(doc)
+		}
+
+		for _, q := range []Q{
+			{"Nick": Exists(true)},
+			{"Nick": Exists(false)},
+			{"Nick": nil},
+			{"Nick": Ne(nil)},
+			{"Nick": Nin(nil, "Nick 1")},
+			{"Nick": Ne("Nick 1")},
+			{"Nick": "Nick 2"},
+		} {
+			n, _ := scan.Find(q, 0, 0)
+			assert.Equal(t, indexed.Count(q), n, "count for %v matches a scan", q)
+			n, _ = indexed.Find(q, 0, 0)
+			assert.Equal(t, indexed.Count(q), n, "count for %v matches Find", q)
+		}
+	}
+}
+
+type TestTaggedDoc struct {
+	ID       ObjectID
+	Name     string `godb:"name,index"`
+	Nickname string `godb:"nick,omitempty"`
+	Email    string `godb:",unique"`
+	Password string `godb:"-"`
+	visits   int
+}
+
+func TestStructTags(t *testing.T) {
+	db := NewDatabase()
+	_, docs, err := db.Insert(&TestTaggedDoc{Name: "Ian", Email: "ian@example.com", Password: "secret", visits: 3})
+	assert.Nil(t, err, "no error inserting")
+	assert.Equal(t, docs[0].Fields, map[string]interface{}{"name": "Ian", "Email": "ian@example.com"})
+
+	assert.NotNil(t, db.GetIndex("name"), "declared index is created")
+	assert.NotNil(t, db.GetIndex("Email"), "declared unique index is created")
+	assert.Equal(t, len(db.Indexes), 2, "undeclared fields aren't indexed")
+
+	db.Insert(&TestTaggedDoc{Name: "Bob", Nickname: "Bobby"})
+	assert.Equal(t, db.GetIndex("name").Count, 2, "later documents are indexed")
+
+	n, found := db.Find(&struct {
+		Name string `godb:"name"`
+	}{Name: "Bob"}, 0, 0)
+	assert.Equal(t, n, 1, "tagged query finds the document")
+
+	var d TestTaggedDoc
+	found[0].Unmarshal(&d)
+	assert.Equal(t, d, TestTaggedDoc{ID: found[0].ObjectID, Name: "Bob", Nickname: "Bobby"})
+}
+
+func TestInsertMapsAndJSON(t *testing.T) {
+	db := NewDatabase()
+	db.NewIndex("Name")
+	db.NewIndexWithOptions([]string{"Age"}, Ordered())
+
+	id := NewObjectID()
+	n, docs, err := db.Insert(
+		map[string]interface{}{"Name": "Map", "Age": 30, "Tags": []string{"a", "b"}},
+		json.RawMessage(`{"Name": "Raw", "Age": 31, "Address": {"City": "London"}}`),
+		[]byte(`{"_id": "`+id.Hex()+`", "Name": "Bytes", "Age": 32.5}`),
+		&TestDoc{Name: "Struct", Age: 30},
+	)
+	assert.Nil(t, err, "no error inserting")
+	assert.Equal(t, n, 4, "all documents inserted")
+	assert.Equal(t, docs[0].Fields["Tags"], []interface{}{"a", "b"}, "map values are stored like struct fields")
+	assert.Equal(t, docs[1].Fields["Age"], 31, "whole JSON numbers are ints")
+	assert.Equal(t, docs[2].Fields["Age"], 32.5)
+	assert.Equal(t, docs[2].ObjectID, id, "_id is used as the ObjectID")
+
+	n, _ = db.Find(&struct{ Name string }{Name: "Raw"}, 0, 0)
+	assert.Equal(t, n, 1, "JSON document is indexed")
+	n, _ = db.Find(Q{"Age": 30}, 0, 0)
+	assert.Equal(t, n, 2, "map and struct documents are indexed alike")
+	n, _ = db.Find(Q{"Age": Gt(31)}, 0, 0)
+	assert.Equal(t, n, 1)
+	n, _ = db.Find(Q{"Address.City": "London"}, 0, 0)
+	assert.Equal(t, n, 1, "nested JSON objects are queryable")
+
+	m := docs[1].UnmarshalMap()
+	assert.Equal(t, m, map[string]interface{}{
+		"_id":     docs[1].ObjectID,
+		"Name":    "Raw",
+		"Age":     31,
+		"Address": map[string]interface{}{"City": "London"},
+	})
+	m["Address"].(map[string]interface{})["City"] = "Paris"
+	assert.Equal(t, docs[1].Fields["Address"], map[string]interface{}{"City": "London"}, "map is a copy")
+
+	b, err := json.Marshal(docs[2])
+	assert.Nil(t, err, "no error marshalling JSON")
+	assert.Equal(t, string(b), `{"Age":32.5,"Name":"Bytes","_id":"`+id.Hex()+`"}`)
+
+	_, _, err = db.Insert([]byte(`[1, 2]`))
+	assert.Equal(t, err, ErrInvalidDocument, "JSON must be an object")
+	_, _, err = db.Insert([]byte(`{"Name":`))
+	assert.NotNil(t, err, "invalid JSON isn't inserted")
+	_, _, err = db.Insert(map[string]interface{}{"_id": "nothex"})
+	assert.NotNil(t, err, "invalid _id isn't inserted")
+	assert.Equal(t, len(db.Documents), 4, "db contains 4 documents")
+}
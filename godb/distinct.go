@@ -0,0 +1,246 @@
+package godb
+
+import (
+	"bytes"
+	"github.com/ian-kent/go-log/log"
+	"sort"
+)
+
+// Bucket is the number of documents with one combination of an index's
+// field values, given in the order of the index fields
+type Bucket struct {
+	Values []interface{}
+	Count  int
+}
+
+// Histogram returns the number of documents for each distinct value of
+// the index fields, in value order. Each leaf of the tree holds the
+// documents for one value, so only one document per value is read, or
+// none for an ordered index.
+func (idx *Index) Histogram() []Bucket {
+	idx.Database.WriteLock.RLock()
+	defer idx.Database.WriteLock.RUnlock()
+
+	return idx.histogram(nil)
+}
+
+// histogram returns the buckets whose values match the query, which
+// must only read the index fields. The caller must hold a lock.
+func (idx *Index) histogram(fields map[string]interface{}) []Bucket {
+	buckets := make([]Bucket, 0)
+	var last *Leaf
+	var lastCanonical []byte
+	idx.eachValue(fields, func(l *Leaf, docs []*Document, values map[string]interface{}) {
+		c := idx.canonical(values)
+		if l == last && bytes.Equal(c, lastCanonical) {
+			// missing and nil fields, which share a bucket
+			buckets[len(buckets)-1].Count += len(docs)
+			return
+		}
+		last, lastCanonical = l, c
+
+		b := Bucket{Values: make([]interface{}, len(idx.Fields)), Count: len(docs)}
+		for i, f := range idx.Fields {
+			b.Values[i] = values[f]
+		}
+		buckets = append(buckets, b)
+	})
+
+	if !idx.Ordered {
+		sort.SliceStable(buckets, func(i, j int) bool {
+			for k := range idx.Fields {
+				if c := orderValues(buckets[i].Values[k], buckets[j].Values[k]); c != 0 {
+					return c < 0
+				}
+			}
+			return false
+		})
+	}
+	return buckets
+}
+
+// eachValue calls fn with the leaf, documents and values of each group
+// of documents whose values match the query, which must only read the
+// index fields. A leaf's documents are split by value where they might
+// differ: in a Collided leaf, or under a nil key, which also holds
+// documents missing the field. values leaves out missing fields.
+func (idx *Index) eachValue(fields map[string]interface{}, fn func(*Leaf, []*Document, map[string]interface{})) {
+	r := keyRange{}
+	if idx.Ordered {
+		if qr, _, ok := idx.queryRange(planFields(fields)); ok {
+			r = qr
+		}
+	}
+
+	idx.Tree.Walk(r, func(l *Leaf) bool {
+		if len(l.Documents) == 0 {
+			return true
+		}
+		values, ok := idx.keyValues(l.Unsplit)
+		if !ok {
+			values = idx.leafEntry(l.Documents[0], l.Unsplit)
+		}
+		if !l.Collided && !idx.hasNil(values) {
+			if len(fields) == 0 || matchFields(l.Documents[0], values, fields) {
+				fn(l, l.Documents, values)
+			}
+			return true
+		}
+
+		groups := make(map[string][]*Document)
+		entries := make(map[string]map[string]interface{})
+		order := make([]string, 0)
+		for _, d := range l.Documents {
+			e := idx.leafEntry(d, l.Unsplit)
+			k := idx.entryKey(e)
+			if _, ok := groups[k]; !ok {
+				order = append(order, k)
+				entries[k] = e
+			}
+			groups[k] = append(groups[k], d)
+		}
+		for _, k := range order {
+			docs := groups[k]
+			if len(fields) == 0 || matchFields(docs[0], entries[k], fields) {
+				fn(l, docs, entries[k])
+			}
+		}
+		return true
+	})
+}
+
+// hasNil reports whether any index field value is nil or missing, which
+// share a key
+func (idx *Index) hasNil(values map[string]interface{}) bool {
+	for _, f := range idx.Fields {
+		if values[f] == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// entryKey returns the canonical encoding of an entry's values followed
+// by which fields it has, telling a missing field apart from a nil one
+func (idx *Index) entryKey(e map[string]interface{}) string {
+	b := idx.canonical(e)
+	for _, f := range idx.Fields {
+		if _, ok := e[f]; ok {
+			b = append(b, 1)
+		} else {
+			b = append(b, 0)
+		}
+	}
+	return string(b)
+}
+
+// leafEntry returns the index field values a document is held under in
+// the leaf with key
+func (idx *Index) leafEntry(d *Document, key []byte) map[string]interface{} {
+	entries, _ := idx.docEntries(d.Values())
+	for _, e := range entries {
+		if bytes.Equal(idx.Key(e), key) {
+			return e
+		}
+	}
+	return entries[0]
+}
+
+// Distinct returns the distinct values of field in the documents
+// matching the query, in value order. Elements of list values are
+// distinct values, and equal numbers are one value whatever their type,
+// as Find compares them. If an index includes the field and every field
+// the query reads, it's answered from the index leaves.
+func (db *Database) Distinct(field string, query interface{}) []interface{} {
+	db.WriteLock.RLock()
+	defer db.WriteLock.RUnlock()
+
+	fields := queryFields(query)
+	seen := make(map[string]bool)
+	values := make([]interface{}, 0)
+	add := func(v interface{}) {
+		list, ok := v.([]interface{})
+		if !ok {
+			list = []interface{}{v}
+		}
+		for _, e := range list {
+			key := string(appendHashValue(nil, e))
+			if !seen[key] {
+				seen[key] = true
+				values = append(values, e)
+			}
+		}
+	}
+
+	if idx := db.distinctIndex(field, fields); idx != nil {
+		log.Trace("Using index %s for distinct %s", idx.Name, field)
+		idx.eachValue(fields, func(_ *Leaf, _ []*Document, leafValues map[string]interface{}) {
+			if v, ok := leafValues[field]; ok {
+				add(v)
+			}
+		})
+	} else {
+		docs, exact := db.candidates(fields)
+		for _, d := range docs {
+			v := d.Values()
+			if !exact && !matchFields(d, v, fields) {
+				continue
+			}
+			if field == idField {
+				add(d.ObjectID)
+				continue
+			}
+			if fv, ok := lookupPath(v, field); ok {
+				add(fv)
+			}
+		}
+	}
+
+	sort.SliceStable(values, func(i, j int) bool {
+		return orderValues(values[i], values[j]) < 0
+	})
+	return values
+}
+
+// distinctIndex returns the index with the fewest fields which includes
+// field and every field the query reads
+func (db *Database) distinctIndex(field string, fields map[string]interface{}) *Index {
+	return db.indexCovering(fields, append(queryFieldNames(fields), field)...)
+}
+
+// indexCovering returns the index with the fewest fields which includes
+// every named field and every document the query can match
+func (db *Database) indexCovering(fields map[string]interface{}, names ...string) *Index {
+	var best *Index
+	for _, idx := range db.Indexes {
+		if idx.Multikey || !idx.usableFor(fields) {
+			// a multikey index's leaves hold elements, not the
+			// documents' values
+			continue
+		}
+		covered := true
+		for _, n := range names {
+			if indexOf(idx.Fields, n) < 0 {
+				covered = false
+				break
+			}
+		}
+		if !covered {
+			continue
+		}
+		if best == nil || len(idx.Fields) < len(best.Fields) ||
+			(len(idx.Fields) == len(best.Fields) && idx.Name < best.Name) {
+			best = idx
+		}
+	}
+	return best
+}
+
+func indexOf(fields []string, field string) int {
+	for i, f := range fields {
+		if f == field {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,111 @@
+package godb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+)
+
+func TestDistinct(t *testing.T) {
+	db := NewDatabase()
+	indexed := NewDatabase()
+	indexed.NewIndex("Name")
+	indexed.NewIndexWithOptions([]string{"Age"}, Ordered())
+
+	for i := 0; i < 1000; i++ {
+		doc := &TestDoc{
+			Name: "Test document " + strconv.Itoa(i%7),
+			Age:  i % 10,
+		}
+		db.Insert(doc)
+		indexed.Insert(doc)
+	}
+
+	ages := []interface{}{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	assert.Equal(t, db.Distinct("Age", nil), ages, "distinct ages from a scan")
+	assert.Equal(t, indexed.Distinct("Age", nil), ages, "distinct ages from the index")
+
+	assert.Equal(t, db.Distinct("Age", Q{"Age": Gte(7)}), ages[7:], "distinct ages matching a query")
+	assert.Equal(t, indexed.Distinct("Age", Q{"Age": Gte(7)}), ages[7:], "distinct ages matching a query from the index")
+
+	names := indexed.Distinct("Name", nil)
+	assert.Equal(t, len(names), 7, "7 distinct names")
+	assert.Equal(t, names[0], "Test document 0", "names are in order")
+	assert.Equal(t, db.Distinct("Name", Q{"Age": 3}), indexed.Distinct("Name", Q{"Age": 3}), "query on another field is scanned")
+
+	idx := indexed.distinctIndex("Age", Q{"Age": Gte(7)})
+	assert.Equal(t, idx.Name, "Age", "index is used")
+	idx = indexed.distinctIndex("Name", Q{"Age": 3})
+	assert.Nil(t, idx, "index without the query fields isn't used")
+}
+
+func TestDistinctMatchesScan(t *testing.T) {
+	for _, opts := range [][]IndexOption{nil, {Ordered()}} {
+		scan := NewDatabase()
+		indexed := NewDatabase()
+		indexed.NewIndexWithOptions([]string{"A", "B"}, opts...)
+
+		for _, doc := range []map[string]interface{}{
+			{"A": -1},
+			{"A": 1, "B": 5},
+			{"A": 2, "B": "x"},
+			{"A": int64(2), "B": "x"},
+			{"A": 2.0, "B": "x"},
+			{"A": 3, "B": nil},
+			{"B": 7},
+			{"A": nil, "B": 8},
+		} {
+			scan.Insert(doc)
+			indexed.Insert(doc)
+		}
+
+		tests := []struct {
+			field string
+			query Q
+		}{
+			{"A", nil},
+			{"B", nil},
+			{"B", Q{"A": Lt(2)}},
+			{"B", Q{"A": Exists(false)}},
+			{"B", Q{"A": nil}},
+			{"A", Q{"B": Exists(true)}},
+			{"A", Q{"A": 2}},
+		}
+		for _, test := range tests {
+			assert.NotNil(t, indexed.distinctIndex(test.field, queryFields(test.query)), "index is used for %v", test.query)
+			want := scan.Distinct(test.field, test.query)
+			got := indexed.Distinct(test.field, test.query)
+			if assert.Equal(t, len(got), len(want), "distinct %s for %v matches a scan", test.field, test.query) {
+				for i := range want {
+					assert.True(t, equalValues(got[i], want[i]), "distinct %s for %v: %v, want %v", test.field, test.query, got, want)
+				}
+			}
+		}
+		assert.Equal(t, indexed.Distinct("B", Q{"A": Lt(2)}), []interface{}{5}, "documents missing the field add no value")
+		assert.Equal(t, len(indexed.Distinct("A", Q{"A": 2})), 1, "equal numbers are one value")
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	db := NewDatabase()
+	db.NewIndex("Age")
+	db.NewIndexWithOptions([]string{"Name", "Age"}, Ordered())
+
+	for i := 0; i < 1000; i++ {
+		db.Insert(&TestDoc{
+			Name: "Test document " + strconv.Itoa(i%2),
+			Age:  i % 3,
+		})
+	}
+
+	assert.Equal(t, db.GetIndex("Age").Histogram(), []Bucket{
+		{Values: []interface{}{0}, Count: 334},
+		{Values: []interface{}{1}, Count: 333},
+		{Values: []interface{}{2}, Count: 333},
+	})
+
+	h := db.GetIndex("Name", "Age").Histogram()
+	assert.Equal(t, len(h), 6, "one bucket per name and age")
+	assert.Equal(t, h[0], Bucket{Values: []interface{}{"Test document 0", 0}, Count: 167})
+	assert.Equal(t, h[5], Bucket{Values: []interface{}{"Test document 1", 2}, Count: 166})
+}
@@ -1,72 +1,474 @@
 package godb
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/ian-kent/go-log/log"
 	"reflect"
+	"strings"
+	"sync"
+	"time"
 )
 
+var ErrInvalidDocument = errors.New("Document must be a struct pointer, map or JSON object")
+
+// Document is a stored object. Fields is nil for documents whose body
+// lives in a Storage, use Values to read them.
 type Document struct {
 	ObjectID ObjectID
 	Fields   map[string]interface{}
+
+	// set for documents whose body lives in a Storage
+	storage Storage
+	offset  int64
+}
+
+// idField is the field name used for a document's ObjectID in queries
+// and when marshalling a struct with an ObjectID field
+const idField = "_id"
+
+var objectIDType = reflect.TypeOf(ObjectID(nil))
+
+var timeType = reflect.TypeOf(time.Time{})
+var qType = reflect.TypeOf(Q{})
+
+// FieldInfo describes how a struct field is stored, from its godb tag:
+//
+//	Name  string `godb:"name,omitempty,index"`
+//	Email string `godb:",unique"`
+//	Temp  string `godb:"-"`
+//
+// The first tag option renames the stored field. omitempty skips zero
+// values, index declares an index on the field which is created when
+// the type is first inserted, and unique declares a unique index.
+// Fields tagged "-" and unexported fields aren't stored. The fields of
+// an untagged embedded struct are stored as if they were the outer
+// struct's, as encoding/json does.
+type FieldInfo struct {
+	Field     reflect.StructField
+	Key       string
+	OmitEmpty bool
+	Indexed   bool
+	Unique    bool
 }
 
-var FieldCache = make(map[string][]reflect.StructField)
+var FieldCache = make(map[reflect.Type][]FieldInfo)
+var FieldCacheLock = new(sync.RWMutex)
 
+// GetFields returns the stored fields of a document value: a struct
+// pointer, a map[string]interface{}, or a JSON object as a
+// json.RawMessage or []byte. Nested structs and maps are stored as
+// map[string]interface{} and slices as []interface{}, so they can be
+// queried by dotted paths such as Address.City. An invalid value is
+// logged and has no fields.
 func GetFields(value interface{}) map[string]interface{} {
-	fnm := GetFieldNames(value)
-	fields := make(map[string]interface{}, 0)
-	vl := reflect.ValueOf(value).Elem()
+	fields, err := documentFields(value)
+	if err != nil {
+		log.Error("Error reading document fields: %s", err)
+		return make(map[string]interface{})
+	}
+	return fields
+}
+
+func documentFields(value interface{}) (map[string]interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		fields := make(map[string]interface{}, len(v))
+		for k, fv := range v {
+			fields[k] = storedValue(reflect.ValueOf(fv))
+		}
+		return fields, nil
+	case json.RawMessage:
+		return jsonFields(v)
+	case []byte:
+		return jsonFields(v)
+	}
+
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return nil, ErrInvalidDocument
+	}
+	return structFields(rv.Elem()), nil
+}
 
-	for i, f := range fnm {
-		fields[f.Name] = vl.Field(i).Interface()
+// jsonFields decodes a JSON object. Whole numbers are decoded as ints
+// where they fit, like the int fields of a struct, and other numbers as
+// float64.
+func jsonFields(b []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, ErrInvalidDocument
+	}
+	fields, ok := jsonValue(v).(map[string]interface{})
+	if !ok {
+		return nil, ErrInvalidDocument
+	}
+	return fields, nil
+}
+
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil && int64(int(i)) == i {
+			return int(i)
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = jsonValue(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonValue(e)
+		}
+	}
+	return v
+}
+
+func structFields(vl reflect.Value) map[string]interface{} {
+	fields := make(map[string]interface{}, 0)
+	for _, f := range typeFields(vl.Type()) {
+		fv := vl.FieldByIndex(f.Field.Index)
+		if f.Field.Type == objectIDType {
+			if id := fv.Interface().(ObjectID); len(id) > 0 {
+				fields[idField] = id
+			}
+			continue
+		}
+		if f.OmitEmpty && fv.IsZero() {
+			continue
+		}
+		fields[f.Key] = storedValue(fv)
 	}
 
 	return fields
 }
 
-func GetFieldNames(value interface{}) []reflect.StructField {
-	tp := reflect.TypeOf(value).Elem()
-	tn := tp.Name()
+// storedValue converts a field value to the form it's stored in
+func storedValue(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return nil
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return storedValue(v.Elem())
+	case reflect.Struct:
+		if v.Type() == timeType {
+			return v.Interface()
+		}
+		m := structFields(v)
+		if id, ok := m[idField].(ObjectID); ok {
+			m[idField] = []byte(id)
+		}
+		return m
+	case reflect.Map:
+		if v.IsNil() || v.Type().Key().Kind() != reflect.String || v.Type() == qType {
+			// a Q is a query condition, not a nested value
+			return v.Interface()
+		}
+		m := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			m[iter.Key().String()] = storedValue(iter.Value())
+		}
+		return m
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		if isBytes(v) {
+			return v.Bytes()
+		}
+		fallthrough
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Interface()
+		}
+		s := make([]interface{}, v.Len())
+		for i := range s {
+			s[i] = storedValue(v.Index(i))
+		}
+		return s
+	}
+	if bv, ok := basicValue(v); ok {
+		// named basic types, e.g. type Status string, are stored as
+		// their kind so queries on plain values match them
+		return bv
+	}
+	return v.Interface()
+}
+
+// GetFieldNames returns the stored fields of a struct pointer's type
+func GetFieldNames(value interface{}) []FieldInfo {
+	return typeFields(reflect.TypeOf(value).Elem())
+}
 
-	if fields, ok := FieldCache[tn]; tn != "" && ok {
+func typeFields(tp reflect.Type) []FieldInfo {
+	FieldCacheLock.RLock()
+	fields, ok := FieldCache[tp]
+	FieldCacheLock.RUnlock()
+	if ok {
 		return fields
 	}
 
-	fields := make([]reflect.StructField, tp.NumField())
+	fields = make([]FieldInfo, 0, tp.NumField())
+	promoted := make([]FieldInfo, 0)
 	for i := 0; i < tp.NumField(); i++ {
-		fields[i] = tp.Field(i)
+		sf := tp.Field(i)
+		tag := strings.Split(sf.Tag.Get("godb"), ",")
+		if tag[0] == "-" && len(tag) == 1 {
+			continue
+		}
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct && tag[0] == "" {
+			for _, ef := range typeFields(sf.Type) {
+				ef.Field.Index = append([]int{i}, ef.Field.Index...)
+				promoted = append(promoted, ef)
+			}
+			continue
+		}
+		if sf.PkgPath != "" {
+			// unexported
+			continue
+		}
+		f := FieldInfo{Field: sf, Key: sf.Name}
+		if tag[0] != "" {
+			f.Key = tag[0]
+		}
+		for _, opt := range tag[1:] {
+			switch opt {
+			case "omitempty":
+				f.OmitEmpty = true
+			case "index":
+				f.Indexed = true
+			case "unique":
+				f.Indexed = true
+				f.Unique = true
+			}
+		}
+		fields = append(fields, f)
 	}
-	FieldCache[tn] = fields
+
+	// the outer struct's fields win over promoted ones
+	for _, ef := range promoted {
+		taken := false
+		for _, f := range fields {
+			if f.Key == ef.Key {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			fields = append(fields, ef)
+		}
+	}
+
+	FieldCacheLock.Lock()
+	FieldCache[tp] = fields
+	FieldCacheLock.Unlock()
 
 	return fields
 }
 
+// Marshal converts a struct pointer, map or JSON object to a document.
+// If it has a non-empty ObjectID field, or an _id holding an ObjectID or
+// its hex string, that's used as the document's ObjectID, otherwise a
+// new one is generated. It returns nil if the value isn't a document.
 func Marshal(value interface{}) *Document {
+	doc, err := marshal(value)
+	if err != nil {
+		log.Error("Error marshalling document: %s", err)
+		return nil
+	}
+	return doc
+}
+
+func marshal(value interface{}) (*Document, error) {
+	fields, err := documentFields(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var id ObjectID
+	switch v := fields[idField].(type) {
+	case nil:
+		id = NewObjectID()
+	case ObjectID:
+		id = v
+	case []byte:
+		id = ObjectID(v)
+	case string:
+		if id, err = ParseObjectID(v); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrInvalidObjectID
+	}
+	delete(fields, idField)
+
 	doc := &Document{
-		ObjectID: NewObjectID(),
-		Fields:   GetFields(value),
+		ObjectID: id,
+		Fields:   fields,
 	}
 
-	return doc
+	return doc, nil
+}
+
+// storedFields returns the fields of value without its ObjectID
+func storedFields(value interface{}) (map[string]interface{}, error) {
+	fields, err := documentFields(value)
+	if err != nil {
+		return nil, err
+	}
+	delete(fields, idField)
+	return fields, nil
+}
+
+// Values returns the document's fields, loading them from storage if
+// the body isn't held in memory.
+func (d *Document) Values() map[string]interface{} {
+	if d.Fields != nil || d.storage == nil {
+		return d.Fields
+	}
+
+	fields, err := d.storage.Get(d.offset)
+	if err != nil {
+		log.Error("Error loading document %s: %s", d.ObjectID.Hex(), err)
+		return make(map[string]interface{})
+	}
+	return fields
+}
+
+// UnmarshalMap returns a copy of the document's fields, with its
+// ObjectID as _id, in the form they're stored
+func (d *Document) UnmarshalMap() map[string]interface{} {
+	values := d.Values()
+	m := make(map[string]interface{}, len(values)+1)
+	for k, v := range values {
+		m[k] = copyValue(v)
+	}
+	m[idField] = d.ObjectID
+	return m
 }
 
+// copyValue copies nested maps and slices, so the stored values can't
+// be modified through the copy
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = copyValue(e)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, e := range v {
+			s[i] = copyValue(e)
+		}
+		return s
+	}
+	return v
+}
+
+// MarshalJSON encodes the document as a JSON object, with its ObjectID
+// as a hex string in _id
+func (d *Document) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.UnmarshalMap())
+}
+
+// Unmarshal sets the fields of a struct pointer from the document.
+// Fields missing from the document, or whose stored value can't be
+// converted to the field's type, are left unchanged.
 func (d Document) Unmarshal(value interface{}) {
-	tp := reflect.TypeOf(value).Elem()
-	vl := reflect.ValueOf(value).Elem()
-
-	for i := 0; i < vl.NumField(); i++ {
-		nv := reflect.ValueOf(d.Fields[tp.Field(i).Name])
-
-		switch vl.Field(i).Kind() {
-		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-			vl.Field(i).SetInt(nv.Int())
-		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
-			vl.Field(i).SetUint(nv.Uint())
-		case reflect.Float32, reflect.Float64:
-			vl.Field(i).SetFloat(nv.Float())
-		case reflect.String:
-			vl.Field(i).SetString(nv.String())
-		default:
-			vl.Field(i).Set(nv)
+	setStruct(reflect.ValueOf(value).Elem(), d.Values(), d.ObjectID)
+}
+
+// setStruct sets a struct from stored fields. A nil id is read from the
+// fields, as for nested structs.
+func setStruct(vl reflect.Value, fields map[string]interface{}, id ObjectID) {
+	for _, f := range typeFields(vl.Type()) {
+		fv := vl.FieldByIndex(f.Field.Index)
+		if f.Field.Type == objectIDType {
+			if id != nil {
+				fv.Set(reflect.ValueOf(id))
+			} else if v, ok := fields[idField]; ok {
+				setValue(fv, v)
+			}
+			continue
 		}
+
+		v, ok := fields[f.Key]
+		if !ok {
+			// not in the document, e.g. projected out
+			continue
+		}
+		setValue(fv, v)
+	}
+}
+
+// setValue sets fv from a stored value, converting nested maps and
+// slices back to the field's type
+func setValue(fv reflect.Value, v interface{}) {
+	if v == nil {
+		fv.Set(reflect.Zero(fv.Type()))
+		return
+	}
+	nv := reflect.ValueOf(v)
+
+	switch fv.Kind() {
+	case reflect.Ptr:
+		pv := reflect.New(fv.Type().Elem())
+		setValue(pv.Elem(), v)
+		fv.Set(pv)
+		return
+	case reflect.Struct:
+		if m, ok := v.(map[string]interface{}); ok {
+			setStruct(fv, m, nil)
+			return
+		}
+	case reflect.Map:
+		m, ok := v.(map[string]interface{})
+		if !ok || fv.Type().Key().Kind() != reflect.String {
+			break
+		}
+		mv := reflect.MakeMapWithSize(fv.Type(), len(m))
+		for k, e := range m {
+			ev := reflect.New(fv.Type().Elem()).Elem()
+			setValue(ev, e)
+			mv.SetMapIndex(reflect.ValueOf(k).Convert(fv.Type().Key()), ev)
+		}
+		fv.Set(mv)
+		return
+	case reflect.Slice, reflect.Array:
+		s, ok := v.([]interface{})
+		if !ok {
+			break
+		}
+		sv := fv
+		if fv.Kind() == reflect.Slice {
+			sv = reflect.MakeSlice(fv.Type(), len(s), len(s))
+		}
+		for i := 0; i < len(s) && i < sv.Len(); i++ {
+			setValue(sv.Index(i), s[i])
+		}
+		fv.Set(sv)
+		return
+	}
+
+	switch {
+	case nv.Type().AssignableTo(fv.Type()):
+		fv.Set(nv)
+	case isNumber(v) && isNumber(fv.Interface()),
+		nv.Kind() == fv.Kind() && nv.Type().ConvertibleTo(fv.Type()):
+		fv.Set(nv.Convert(fv.Type()))
 	}
 }
@@ -0,0 +1,113 @@
+package godb
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Plan describes how a query was answered, as returned by Explain
+type Plan struct {
+	// Strategy is how candidates were found: "id", "exact index",
+	// "index", "intersection", "union", "covered index", "sorted index"
+	// or "scan"
+	Strategy string
+	// Index is the index used, and Intersect the second index for an
+	// intersection
+	Index     string
+	Intersect string
+	// Considered lists the indexes which could have answered the query,
+	// best first
+	Considered []string
+	// Sort is "index" if results came from an ordered index in sort
+	// order, "memory" if they were sorted after matching, or empty
+	Sort string
+	// LeavesVisited counts the index leaves read
+	LeavesVisited int
+	// Candidates counts the documents found by the strategy, and
+	// DocumentsExamined those checked against the query
+	Candidates        int
+	DocumentsExamined int
+	// DocumentsMatched counts all matching documents and
+	// DocumentsReturned those in the requested page
+	DocumentsMatched  int
+	DocumentsReturned int
+	Elapsed           time.Duration
+}
+
+// Explain runs the query as FindWithOptions would and reports how it
+// was answered
+func (db *Database) Explain(query interface{}, opts FindOptions) Plan {
+	db.WriteLock.RLock()
+	defer db.WriteLock.RUnlock()
+
+	p := &Plan{Considered: make([]string, 0)}
+	start := time.Now()
+	n, docs := db.findWithPlan(queryFields(query), opts, p)
+	p.Elapsed = time.Since(start)
+	p.DocumentsMatched = n
+	p.DocumentsReturned = len(docs)
+	return *p
+}
+
+func (p Plan) String() string {
+	lines := []string{"Strategy: " + p.Strategy}
+	if p.Index != "" {
+		lines = append(lines, "Index: "+p.Index)
+	}
+	if p.Intersect != "" {
+		lines = append(lines, "Intersect: "+p.Intersect)
+	}
+	if len(p.Considered) > 0 {
+		lines = append(lines, "Considered: "+strings.Join(p.Considered, ", "))
+	}
+	if p.Sort != "" {
+		lines = append(lines, "Sort: "+p.Sort)
+	}
+	lines = append(lines,
+		fmt.Sprintf("Leaves visited: %d", p.LeavesVisited),
+		fmt.Sprintf("Candidates: %d", p.Candidates),
+		fmt.Sprintf("Documents examined: %d", p.DocumentsExamined),
+		fmt.Sprintf("Documents matched: %d", p.DocumentsMatched),
+		fmt.Sprintf("Documents returned: %d", p.DocumentsReturned),
+		fmt.Sprintf("Elapsed: %s", p.Elapsed),
+	)
+	return strings.Join(lines, "\n")
+}
+
+// The methods below record what the query did, and do nothing on a nil
+// plan so the query functions can be run without one.
+
+func (p *Plan) strategy(strategy string, idx *Index) {
+	if p == nil {
+		return
+	}
+	p.Strategy = strategy
+	if idx != nil {
+		p.Index = idx.Name
+	}
+}
+
+func (p *Plan) consider(idx *Index) {
+	if p != nil {
+		p.Considered = append(p.Considered, idx.Name)
+	}
+}
+
+func (p *Plan) leaf() {
+	if p != nil {
+		p.LeavesVisited++
+	}
+}
+
+func (p *Plan) candidates(n int) {
+	if p != nil {
+		p.Candidates += n
+	}
+}
+
+func (p *Plan) examined() {
+	if p != nil {
+		p.DocumentsExamined++
+	}
+}
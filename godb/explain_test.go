@@ -0,0 +1,56 @@
+package godb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	db := NewDatabase()
+	db.NewIndex("Name")
+	db.NewIndex("Name", "Age")
+	db.NewIndexWithOptions([]string{"Age"}, Ordered())
+
+	for i := 0; i < 1000; i++ {
+		db.Insert(&TestDoc{
+			Name: "Test document " + strconv.Itoa(i%100),
+			Age:  i % 7,
+		})
+	}
+
+	p := db.Explain(&struct {
+		Age  int
+		Name string
+	}{Age: 3, Name: "Test document 10"}, FindOptions{})
+	assert.Equal(t, p.Strategy, "exact index")
+	assert.Equal(t, p.Index, "Name-Age")
+	assert.Equal(t, p.LeavesVisited, 1)
+	assert.Equal(t, p.DocumentsExamined, 0, "exact index results aren't examined")
+	assert.Equal(t, p.DocumentsReturned, 2)
+
+	p = db.Explain(Q{"Name": "Test document 10", "Age": Gte(3)}, FindOptions{Limit: 2})
+	assert.Equal(t, p.Strategy, "intersection")
+	assert.Equal(t, p.Index, "Name")
+	assert.Equal(t, p.Intersect, "Age")
+	assert.Equal(t, p.Considered, []string{"Name", "Age"})
+	assert.Equal(t, p.DocumentsExamined, p.Candidates, "every candidate is examined")
+	assert.Equal(t, p.DocumentsMatched, 6)
+	assert.Equal(t, p.DocumentsReturned, 2)
+
+	p = db.Explain(Q{"Age": Gt(3)}, FindOptions{Sort: []SortField{Desc("Age")}, Limit: 10})
+	assert.Equal(t, p.Strategy, "sorted index")
+	assert.Equal(t, p.Sort, "index")
+	assert.Equal(t, p.LeavesVisited, 4, "one leaf per age from 3")
+
+	p = db.Explain(Q{"Email": "x"}, FindOptions{Sort: []SortField{Asc("Name")}})
+	assert.Equal(t, p.Strategy, "scan")
+	assert.Equal(t, p.Sort, "memory")
+	assert.Equal(t, p.DocumentsExamined, 1000)
+	assert.Equal(t, p.DocumentsMatched, 0)
+
+	s := p.String()
+	assert.True(t, strings.Contains(s, "Strategy: scan"), "plan prints its strategy")
+	assert.True(t, strings.Contains(s, "Documents examined: 1000"), "plan prints its counts")
+}
@@ -0,0 +1,111 @@
+package godb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Value type tags for the canonical encoding hashed by unordered
+// indexes. Numbers are tagged by value rather than Go type, so values
+// which compare equal encode the same.
+const (
+	hashNil byte = iota
+	hashBool
+	hashInt
+	hashUint
+	hashFloat
+	hashString
+	hashBytes
+	hashTime
+	hashList
+	hashMap
+	hashOther
+)
+
+// appendHashValue appends the canonical encoding of v. Every value is
+// tagged and length prefixed, so encodings are prefix-free and distinct
+// values never share an encoding:
+//
+//   - whole numbers of any type are encoded as a negative int64 or a
+//     non-negative uint64, and other floats by their bits
+//   - []byte and named byte slices such as ObjectID share an encoding
+//   - times are encoded as an instant, whatever their location
+//   - slices and arrays are encoded element by element, and string keyed
+//     maps in key order, whatever their element types
+func appendHashValue(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(b, hashNil)
+	case time.Time:
+		var buf [12]byte
+		binary.BigEndian.PutUint64(buf[0:8], uint64(v.Unix()))
+		binary.BigEndian.PutUint32(buf[8:12], uint32(v.Nanosecond()))
+		return append(append(b, hashTime), buf[:]...)
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Bool:
+		if rv.Bool() {
+			return append(b, hashBool, 1)
+		}
+		return append(b, hashBool, 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i := rv.Int(); i < 0 {
+			return appendUint64(append(b, hashInt), uint64(i))
+		}
+		return appendUint64(append(b, hashUint), uint64(rv.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return appendUint64(append(b, hashUint), rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		if f == math.Trunc(f) && f >= math.MinInt64 && f < 0 {
+			return appendUint64(append(b, hashInt), uint64(int64(f)))
+		}
+		if f == math.Trunc(f) && f >= 0 && f < math.MaxUint64 {
+			return appendUint64(append(b, hashUint), uint64(f))
+		}
+		return appendUint64(append(b, hashFloat), math.Float64bits(f))
+	case reflect.String:
+		return appendString(append(b, hashString), rv.String())
+	case reflect.Slice, reflect.Array:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			bs := make([]byte, rv.Len())
+			reflect.Copy(reflect.ValueOf(bs), rv)
+			return appendBytes(append(b, hashBytes), bs)
+		}
+		b = appendUvarint(append(b, hashList), uint64(rv.Len()))
+		for i := 0; i < rv.Len(); i++ {
+			b = appendHashValue(b, rv.Index(i).Interface())
+		}
+		return b
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			break
+		}
+		keys := make([]string, 0, rv.Len())
+		for _, k := range rv.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		sort.Strings(keys)
+		b = appendUvarint(append(b, hashMap), uint64(len(keys)))
+		for _, k := range keys {
+			b = appendString(b, k)
+			b = appendHashValue(b, rv.MapIndex(reflect.ValueOf(k).Convert(rv.Type().Key())).Interface())
+		}
+		return b
+	}
+
+	// not a stored type, so only equal to itself
+	return appendString(append(b, hashOther), fmt.Sprintf("%T:%#v", v, v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
@@ -0,0 +1,116 @@
+package godb
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+// hashTestValue generates values of every stored type, from small
+// domains so that equal values of different types come up often
+type hashTestValue struct {
+	V interface{}
+}
+
+func (hashTestValue) Generate(r *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(hashTestValue{randomValue(r, 2)})
+}
+
+func randomValue(r *rand.Rand, depth int) interface{} {
+	n := 16
+	if depth == 0 {
+		n = 13
+	}
+	switch r.Intn(n) {
+	case 0:
+		return nil
+	case 1:
+		return r.Intn(2) == 0
+	case 2:
+		return r.Intn(7) - 3
+	case 3:
+		return int64(r.Intn(7) - 3)
+	case 4:
+		return uint8(r.Intn(4))
+	case 5:
+		return float64(r.Intn(13)-6) / 2
+	case 6:
+		return float32(r.Intn(13)-6) / 2
+	case 7:
+		return string("ab"[:r.Intn(3)])
+	case 8:
+		return []byte("ab"[:r.Intn(3)])
+	case 9:
+		return ObjectID("ab"[:r.Intn(3)])
+	case 10:
+		t := time.Unix(int64(r.Intn(3)), int64(r.Intn(2)))
+		if r.Intn(2) == 0 {
+			return t.In(time.FixedZone("X", 3600))
+		}
+		return t.UTC()
+	case 11:
+		return []string{"a", "b"}[:r.Intn(3)]
+	case 12:
+		return map[string]int{"a": r.Intn(2)}
+	case 13:
+		l := make([]interface{}, r.Intn(3))
+		for i := range l {
+			l[i] = randomValue(r, depth-1)
+		}
+		return l
+	}
+	m := make(map[string]interface{})
+	for i := r.Intn(3); i > 0; i-- {
+		m[string("ab"[r.Intn(2)])] = randomValue(r, depth-1)
+	}
+	return m
+}
+
+func TestHashDistinctValues(t *testing.T) {
+	distinct := func(a, b hashTestValue) bool {
+		same := bytes.Equal(appendHashValue(nil, a.V), appendHashValue(nil, b.V))
+		return same == equalValues(a.V, b.V)
+	}
+	err := quick.Check(distinct, &quick.Config{MaxCount: 100000})
+	assert.Nil(t, err, "values share an encoding only if they're equal")
+
+	prefixFree := func(a, b, c, d hashTestValue) bool {
+		ab := appendHashValue(appendHashValue(nil, a.V), b.V)
+		cd := appendHashValue(appendHashValue(nil, c.V), d.V)
+		return bytes.Equal(ab, cd) == (equalValues(a.V, c.V) && equalValues(b.V, d.V))
+	}
+	err = quick.Check(prefixFree, &quick.Config{MaxCount: 100000})
+	assert.Nil(t, err, "compound keys share an encoding only if every field is equal")
+}
+
+func TestIndexHashTypes(t *testing.T) {
+	values := []interface{}{
+		nil, false, true, 0, 1, int64(1), uint(1), 1.0, 1.5, float32(1.5), -1, -1.0,
+		"", "1", []byte("1"), ObjectID("1"),
+		time.Unix(1, 0), time.Unix(1, 0).In(time.FixedZone("X", 3600)), time.Unix(2, 0),
+		[]interface{}{1, "a"}, []interface{}{"a", 1},
+		map[string]interface{}{"a": 1}, map[string]interface{}{"a": 1.5}, map[string]interface{}{"b": 1},
+	}
+
+	scan := NewDatabase()
+	indexed := NewDatabase()
+	indexed.NewIndex("V")
+	for _, v := range values {
+		scan.Insert(map[string]interface{}{"V": v})
+		indexed.Insert(map[string]interface{}{"V": v})
+	}
+
+	for _, v := range values {
+		if isList(v) {
+			continue
+		}
+		n, _ := scan.Find(Q{"V": v}, 0, 0)
+		n2, _ := indexed.Find(Q{"V": v}, 0, 0)
+		assert.Equal(t, n2, n, "index finds the same documents as a scan for %#v", v)
+		assert.Equal(t, indexed.Explain(Q{"V": v}, FindOptions{}).Index, "V", "index is used for %#v", v)
+	}
+}
@@ -4,15 +4,17 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"encoding/base64"
-	"encoding/binary"
 	"errors"
 	"github.com/ian-kent/go-log/log"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
 )
 
 var ErrNoFields = errors.New("No fields to index")
 var ErrIndexAlreadyExists = errors.New("Index already exists")
+var ErrIndexOptionsConflict = errors.New("Index already exists with conflicting options")
 
 type Index struct {
 	Name      string
@@ -21,6 +23,53 @@ type Index struct {
 	Count     int
 	Documents []*Document
 	Database  *Database
+	Ordered   bool
+	Unique    bool
+	Sparse    bool
+	// Filter is the query documents must match to be indexed, for a
+	// partial index
+	Filter Q
+	// Multikey is set once a document has a slice value for an index
+	// field. Each element is indexed, so a document can be in several
+	// leaves and Count is the number of entries rather than documents.
+	Multikey bool
+}
+
+// IndexOption configures an index created with NewIndexWithOptions
+type IndexOption func(*Index)
+
+// Ordered keys the index on an order-preserving encoding of the field
+// values instead of a hash, so it can answer range and prefix queries.
+func Ordered() IndexOption {
+	return func(idx *Index) {
+		idx.Ordered = true
+	}
+}
+
+// Unique rejects writes which would give two documents equal values
+// for the index fields with an ErrDuplicateKey. Documents without the
+// fields count as having nil values.
+func Unique() IndexOption {
+	return func(idx *Index) {
+		idx.Unique = true
+	}
+}
+
+// Sparse skips documents which have none of the index fields, rather
+// than indexing them under nil values
+func Sparse() IndexOption {
+	return func(idx *Index) {
+		idx.Sparse = true
+	}
+}
+
+// PartialFilter only indexes documents matching the filter, e.g.
+// godb.PartialFilter(godb.Q{"Age": godb.Gte(18)}). The filter is logged
+// with the index, so can't hold a compiled Regex.
+func PartialFilter(filter Q) IndexOption {
+	return func(idx *Index) {
+		idx.Filter = filter
+	}
 }
 
 type Leaf struct {
@@ -30,6 +79,12 @@ type Leaf struct {
 	Children  map[byte]*Leaf
 	Documents []*Document
 	Unsplit   []byte
+
+	// Canonical is the canonical encoding of the field values of a
+	// hashed index leaf's documents. Collided is set if documents with
+	// different values were added, when their hashes collide.
+	Canonical []byte
+	Collided  bool
 }
 
 func makeIndexName(fields ...string) string {
@@ -39,81 +94,222 @@ func makeIndexName(fields ...string) string {
 }
 
 func NewIndexes(db *Database, fields ...[]string) ([]*Index, error) {
-	if len(fields) == 0 {
-		return nil, ErrNoFields
+	idxs := make([]*Index, len(fields))
+	for i, fl := range fields {
+		idxs[i] = newIndex(db, fl)
 	}
 
-	for _, fl := range fields {
-		if len(fl) == 0 {
-			return nil, ErrNoFields
-		}
+	db.WriteLock.Lock()
+	defer db.WriteLock.Unlock()
+
+	if err := buildIndexes(db, idxs...); err != nil {
+		return nil, err
+	}
+	return idxs, nil
+}
+
+func NewIndex(db *Database, fields ...string) (*Index, error) {
+	return NewIndexWithOptions(db, fields)
+}
+
+func NewIndexWithOptions(db *Database, fields []string, opts ...IndexOption) (*Index, error) {
+	idx := newIndex(db, fields, opts...)
+
+	db.WriteLock.Lock()
+	defer db.WriteLock.Unlock()
+
+	if err := buildIndexes(db, idx); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// newIndex returns an empty index which hasn't been built
+func newIndex(db *Database, fields []string, opts ...IndexOption) *Index {
+	idx := &Index{
+		Fields:    fields,
+		Count:     0,
+		Documents: make([]*Document, 0),
+		Database:  db,
+		Name:      makeIndexName(fields...),
+	}
+	for _, opt := range opts {
+		opt(idx)
+	}
+	idx.Tree = idx.NewLeaf([]byte{})
+	return idx
+}
+
+// buildIndexes indexes the existing documents. The caller must hold the
+// write lock.
+func buildIndexes(db *Database, idxs ...*Index) error {
+	if len(idxs) == 0 {
+		return ErrNoFields
 	}
 
-	for _, fl := range fields {
-		indexName := makeIndexName(fl...)
-		if _, ok := db.Indexes[indexName]; ok {
-			return nil, ErrIndexAlreadyExists
+	for _, idx := range idxs {
+		if len(idx.Fields) == 0 {
+			return ErrNoFields
 		}
 	}
 
-	idxs := make([]*Index, len(fields))
+	for _, idx := range idxs {
+		if _, ok := db.Indexes[idx.Name]; ok {
+			return ErrIndexAlreadyExists
+		}
+	}
 
-	for i, fl := range fields {
-		indexName := makeIndexName(fl...)
-		idx := &Index{
-			Fields:    fl,
-			Count:     0,
-			Documents: make([]*Document, 0),
-			Database:  db,
-			Name:      indexName,
+	keys := make(uniqueKeys)
+	for _, doc := range db.Documents {
+		if err := keys.claim(idxs, doc.ObjectID, nil, doc.Values()); err != nil {
+			return err
 		}
-		idx.Tree = idx.NewLeaf([]byte{})
-		idxs[i] = idx
 	}
 
-	db.WriteLock.Lock()
 	for _, doc := range db.Documents {
 		for _, idx := range idxs {
 			idx.Index(doc)
 		}
 	}
-	db.WriteLock.Unlock()
 
-	return idxs, nil
+	return nil
 }
 
-func NewIndex(db *Database, fields ...string) (*Index, error) {
-	if len(fields) == 0 {
-		return nil, ErrNoFields
+// options returns the index options in the form they're persisted
+func (idx *Index) options() map[string]interface{} {
+	opts := make(map[string]interface{})
+	if idx.Ordered {
+		opts["ordered"] = true
+	}
+	if idx.Unique {
+		opts["unique"] = true
+	}
+	if idx.Sparse {
+		opts["sparse"] = true
+	}
+	if idx.Filter != nil {
+		opts["filter"] = storedFilter(idx.Filter)
 	}
+	return opts
+}
 
-	indexName := makeIndexName(fields...)
+func indexOptions(opts map[string]interface{}) []IndexOption {
+	o := make([]IndexOption, 0)
+	if opts["ordered"] == true {
+		o = append(o, Ordered())
+	}
+	if opts["unique"] == true {
+		o = append(o, Unique())
+	}
+	if opts["sparse"] == true {
+		o = append(o, Sparse())
+	}
+	if f, ok := opts["filter"].(map[string]interface{}); ok {
+		o = append(o, PartialFilter(loadedFilter(f).(Q)))
+	}
+	return o
+}
 
-	if _, ok := db.Indexes[indexName]; ok {
-		return nil, ErrIndexAlreadyExists
+// FindLeaf returns the leaf holding documents for the field values, or
+// nil if there are none. If the leaf of a hashed index is Collided its
+// documents must be checked against the values.
+func (idx *Index) FindLeaf(fields map[string]interface{}) *Leaf {
+	key := idx.Key(fields)
+	l := idx.Tree.Lookup(key)
+	if l == nil || idx.Ordered || l.Collided {
+		return l
 	}
+	if !bytes.Equal(l.Canonical, idx.canonical(fields)) {
+		// the values' hash collides with the leaf's
+		return nil
+	}
+	return l
+}
 
-	idx := &Index{
-		Fields:    fields,
-		Count:     0,
-		Documents: make([]*Document, 0),
-		Database:  db,
-		Name:      indexName,
+// canonical returns the canonical encoding of the index field values
+func (idx *Index) canonical(fields map[string]interface{}) []byte {
+	b := make([]byte, 0)
+	for _, f := range idx.Fields {
+		b = appendHashValue(b, fields[f])
 	}
-	idx.Tree = idx.NewLeaf([]byte{})
+	return b
+}
 
-	db.WriteLock.Lock()
-	for _, doc := range db.Documents {
-		idx.Index(doc)
+// Key returns the tree key for the field values, a hash for unordered
+// indexes or the concatenated order-preserving encodings for ordered
+func (idx *Index) Key(fields map[string]interface{}) []byte {
+	if !idx.Ordered {
+		return idx.GetIndexHash(fields)
 	}
-	db.WriteLock.Unlock()
 
-	return idx, nil
+	b := make([]byte, 0)
+	values := make([]interface{}, len(idx.Fields))
+	for i, f := range idx.Fields {
+		values[i] = fields[f]
+		b = appendKey(b, values[i])
+	}
+	return appendKinds(b, values)
 }
 
-func (idx *Index) FindLeaf(fields map[string]interface{}) *Leaf {
-	key := idx.GetIndexHash(fields)
-	return idx.Tree.GetLeaf(key, 0)
+// keyValues decodes the field values from an ordered index key. It
+// returns false if any value can't be decoded exactly.
+func (idx *Index) keyValues(key []byte) (map[string]interface{}, bool) {
+	if !idx.Ordered {
+		return nil, false
+	}
+	values := make(map[string]interface{}, len(idx.Fields))
+	for _, f := range idx.Fields {
+		v, rest, ok := decodeKey(key)
+		if !ok {
+			return nil, false
+		}
+		values[f] = v
+		key = rest
+	}
+
+	// then the kinds of the numbers, in field order
+	for _, f := range idx.Fields {
+		n, ok := values[f].(numberKey)
+		if !ok {
+			continue
+		}
+		if len(key) == 0 {
+			return nil, false
+		}
+		if values[f], ok = decodeNumber(n, reflect.Kind(key[0])); !ok {
+			return nil, false
+		}
+		key = key[1:]
+	}
+	return values, true
+}
+
+// queryRange returns the key range to scan for a query on an ordered
+// index, and how many of the leading index fields it constrains. The
+// query must constrain at least the first field.
+func (idx *Index) queryRange(fields map[string]interface{}) (keyRange, int, bool) {
+	prefix := make([]byte, 0)
+	for i, f := range idx.Fields {
+		cond, ok := fields[f]
+		if ok && isOperator(cond) {
+			if r, ok := fieldRange(prefix, cond); ok {
+				return r, i + 1, true
+			}
+			ok = false
+		}
+		if ok && isList(cond) {
+			// slice values are indexed by element
+			ok = false
+		}
+		if !ok {
+			if i == 0 {
+				return keyRange{}, 0, false
+			}
+			return keyRange{Lo: prefix, Hi: prefix}, i, true
+		}
+		prefix = appendKey(prefix, cond)
+	}
+	return keyRange{Lo: prefix, Hi: prefix}, len(idx.Fields), true
 }
 
 func bytesToHash(value []byte) string {
@@ -146,15 +342,24 @@ func (leaf *Leaf) AddDocument(doc *Document, value []byte) *Leaf {
 		// split this leaf
 		//log.Trace("Need to split leaf %s (unsplit for %s) for value %s", func() (string, string, string) { return leaf.GetHash(), bytesToHash(leaf.Unsplit), bytesToHash(value) })
 		unsplit := leaf.Unsplit
-		leaf.Children[unsplit[len(leaf.LeafValue)]] = leaf.Index.NewLeaf(unsplit[:len(leaf.LeafValue)+1])
-		leaf.Children[unsplit[len(leaf.LeafValue)]].Documents = leaf.Documents
-		leaf.Children[unsplit[len(leaf.LeafValue)]].Unsplit = unsplit
+		n := len(leaf.LeafValue)
+		child := leaf.Index.NewLeaf(unsplit[:n+1])
+		child.Documents = leaf.Documents
+		child.Unsplit = unsplit
+		child.Canonical = leaf.Canonical
+		child.Collided = leaf.Collided
+		leaf.Children[unsplit[n]] = child
 		leaf.Unsplit = nil
 		leaf.Documents = make([]*Document, 0)
-		leaf.Children[value[len(leaf.LeafValue)]] = leaf.Index.NewLeaf(value[:len(leaf.LeafValue)+1])
-		l := leaf.Children[value[len(leaf.LeafValue)]]
-		l.AddDocument(doc, value)
-		return l
+		leaf.Canonical = nil
+		leaf.Collided = false
+		if value[n] == unsplit[n] {
+			// values share the next byte too, keep splitting
+			return child.AddDocument(doc, value)
+		}
+		leaf.Children[value[n]] = leaf.Index.NewLeaf(value[:n+1])
+		l := leaf.Children[value[n]]
+		return l.AddDocument(doc, value)
 	}
 
 	if leaf.Unsplit == nil && len(leaf.Documents) == 0 {
@@ -174,38 +379,244 @@ func (leaf *Leaf) AddDocument(doc *Document, value []byte) *Leaf {
 	return leaf
 }
 
+// GetIndexHash returns the SHA-1 of the canonical encodings of the
+// index field values, so equal values share a leaf whatever their type
 func (idx *Index) GetIndexHash(fields map[string]interface{}) []byte {
 	fh := sha1.New()
-	for _, f := range idx.Fields {
-		v := fields[f]
-		switch v.(type) {
-		case string:
-			fh.Write([]byte(v.(string)))
-		case int:
-			b := make([]byte, 8)
-			binary.PutVarint(b, int64(v.(int)))
-			fh.Write(b)
-		default:
-			// ?
-		}
-	}
+	fh.Write(idx.canonical(fields))
 	b := fh.Sum(nil)
 	//log.Trace("Hash: %s", base64.StdEncoding.EncodeToString(b))
 	return b
 }
 
-func (idx *Index) Index(doc *Document) {
-	fm := make(map[string]interface{})
+// docKeys returns the tree keys for a document's values, one for each
+// combination of the elements of any slice values, and whether there
+// were slice values
+func (idx *Index) docKeys(values map[string]interface{}) ([][]byte, bool) {
+	entries, multi := idx.docEntries(values)
+	keys := make([][]byte, len(entries))
+	for i, e := range entries {
+		keys[i] = idx.Key(e)
+	}
+	return keys, multi
+}
+
+// docEntries returns the field values a document is indexed under, as
+// for docKeys. Fields the document lacks are left out, so they aren't
+// taken as nil when the entry is matched, though both have the same key.
+func (idx *Index) docEntries(values map[string]interface{}) ([]map[string]interface{}, bool) {
+	multi := false
+	combos := []map[string]interface{}{make(map[string]interface{}, len(idx.Fields))}
 	for _, f := range idx.Fields {
-		if v, ok := doc.Fields[f]; ok {
-			fm[f] = v
+		v, ok := lookupPath(values, f)
+		if !ok {
+			continue
+		}
+		elems := []interface{}{v}
+		if list, ok := v.([]interface{}); ok && len(list) > 0 {
+			elems = list
+			multi = true
+		}
+
+		next := make([]map[string]interface{}, 0, len(combos)*len(elems))
+		for _, c := range combos {
+			for _, e := range elems {
+				m := make(map[string]interface{}, len(c)+1)
+				for k, cv := range c {
+					m[k] = cv
+				}
+				m[f] = e
+				next = append(next, m)
+			}
+		}
+		combos = next
+	}
+
+	entries := make([]map[string]interface{}, 0, len(combos))
+	seen := make(map[string]bool, len(combos))
+	for _, c := range combos {
+		k := string(idx.Key(c))
+		if !seen[k] {
+			seen[k] = true
+			entries = append(entries, c)
+		}
+	}
+	return entries, multi
+}
+
+func (idx *Index) Index(doc *Document) {
+	if !idx.includes(doc, doc.Values()) {
+		return
+	}
+	entries, multi := idx.docEntries(doc.Values())
+	if multi {
+		idx.Multikey = true
+	}
+	for _, e := range entries {
+		hash := idx.Key(e)
+		leaf := idx.Tree.GetLeaf(hash, 0)
+		leaf = leaf.AddDocument(doc, hash)
+		if !idx.Ordered {
+			leaf.addCanonical(idx.canonical(e))
+		}
+		idx.Count += 1
+	}
+}
+
+// addCanonical records the canonical values of a document added to the
+// leaf, marking it Collided if they differ from the other documents'
+func (leaf *Leaf) addCanonical(c []byte) {
+	leaf.Lock.Lock()
+	defer leaf.Lock.Unlock()
+
+	if leaf.Canonical == nil {
+		leaf.Canonical = c
+	} else if !bytes.Equal(leaf.Canonical, c) {
+		leaf.Collided = true
+	}
+}
+
+// Remove removes the documents from the index, pruning any leaves
+// which are left empty.
+func (idx *Index) Remove(docs ...*Document) {
+	byHash := make(map[string]map[*Document]bool)
+	for _, doc := range docs {
+		keys, _ := idx.docKeys(doc.Values())
+		for _, k := range keys {
+			hash := string(k)
+			if _, ok := byHash[hash]; !ok {
+				byHash[hash] = make(map[*Document]bool)
+			}
+			byHash[hash][doc] = true
+		}
+	}
+
+	for hash, set := range byHash {
+		n, _ := idx.Tree.RemoveDocuments(set, []byte(hash))
+		idx.Count -= n
+	}
+}
+
+// RemoveDocuments removes the documents in set from the leaf holding
+// value. It returns the number of documents removed, and whether this
+// leaf is now empty and can be pruned from its parent.
+func (leaf *Leaf) RemoveDocuments(set map[*Document]bool, value []byte) (int, bool) {
+	leaf.Lock.Lock()
+	defer leaf.Lock.Unlock()
+
+	if len(leaf.Children) == 0 {
+		if leaf.Unsplit == nil || !bytes.Equal(leaf.Unsplit, value) {
+			return 0, false
+		}
+
+		// copy rather than filter in place, Find hands out
+		// slices of leaf.Documents
+		docs := make([]*Document, 0, len(leaf.Documents))
+		for _, d := range leaf.Documents {
+			if !set[d] {
+				docs = append(docs, d)
+			}
+		}
+		n := len(leaf.Documents) - len(docs)
+		leaf.Documents = docs
+		if len(docs) > 0 {
+			return n, false
+		}
+		leaf.Unsplit = nil
+		leaf.Canonical = nil
+		leaf.Collided = false
+		return n, true
+	}
+
+	offset := len(leaf.LeafValue)
+	if len(value) <= offset {
+		return 0, false
+	}
+	child, ok := leaf.Children[value[offset]]
+	if !ok {
+		return 0, false
+	}
+
+	n, empty := child.RemoveDocuments(set, value)
+	if empty {
+		delete(leaf.Children, value[offset])
+	}
+	return n, len(leaf.Children) == 0 && len(leaf.Documents) == 0
+}
+
+// Walk calls fn with each leaf holding documents whose key is in r, in
+// key order, until fn returns false
+func (leaf *Leaf) Walk(r keyRange, fn func(*Leaf) bool) bool {
+	return leaf.walk(r, false, fn)
+}
+
+// WalkReverse is Walk in descending key order
+func (leaf *Leaf) WalkReverse(r keyRange, fn func(*Leaf) bool) bool {
+	return leaf.walk(r, true, fn)
+}
+
+func (leaf *Leaf) walk(r keyRange, reverse bool, fn func(*Leaf) bool) bool {
+	leaf.Lock.Lock()
+	if len(leaf.Children) == 0 {
+		unsplit := leaf.Unsplit
+		leaf.Lock.Unlock()
+		if unsplit == nil || !r.contains(unsplit) {
+			return true
+		}
+		return fn(leaf)
+	}
+
+	keys := make([]int, 0, len(leaf.Children))
+	for k := range leaf.Children {
+		keys = append(keys, int(k))
+	}
+	if reverse {
+		sort.Sort(sort.Reverse(sort.IntSlice(keys)))
+	} else {
+		sort.Ints(keys)
+	}
+	children := make([]*Leaf, len(keys))
+	for i, k := range keys {
+		children[i] = leaf.Children[byte(k)]
+	}
+	leaf.Lock.Unlock()
+
+	for _, c := range children {
+		if !r.mayContain(c.LeafValue) {
+			continue
+		}
+		if !c.walk(r, reverse, fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// Lookup returns the leaf holding documents for value without creating
+// any leaves, or nil if value isn't in the tree
+func (leaf *Leaf) Lookup(value []byte) *Leaf {
+	l := leaf
+	for {
+		l.Lock.Lock()
+		if len(l.Children) == 0 {
+			found := l.Unsplit != nil && bytes.Equal(l.Unsplit, value)
+			l.Lock.Unlock()
+			if found {
+				return l
+			}
+			return nil
+		}
+		if len(value) <= len(l.LeafValue) {
+			l.Lock.Unlock()
+			return nil
+		}
+		c, ok := l.Children[value[len(l.LeafValue)]]
+		l.Lock.Unlock()
+		if !ok {
+			return nil
 		}
+		l = c
 	}
-	//log.Trace("fm: %s", fm)
-	hash := idx.GetIndexHash(fm)
-	leaf := idx.Tree.GetLeaf(hash, 0)
-	leaf = leaf.AddDocument(doc, hash)
-	idx.Count += 1
 }
 
 func (leaf *Leaf) GetLeaf(value []byte, offset int) *Leaf {
@@ -1,7 +1,9 @@
 package godb
 
 import (
+	"bytes"
 	"github.com/stretchr/testify/assert"
+	"math"
 	"math/rand"
 	"strconv"
 	"testing"
@@ -20,7 +22,7 @@ func TestNewPostInsertIndex(t *testing.T) {
 			Name: "Test document " + strconv.Itoa(i),
 			Age:  age,
 		}
-		n, _ := db.Insert(doc)
+		n, _, _ := db.Insert(doc)
 		docs += n
 	}
 
@@ -61,7 +63,7 @@ func TestNewPreInsertIndex(t *testing.T) {
 			Name: "Test document " + strconv.Itoa(i),
 			Age:  age,
 		}
-		n, _ := db.Insert(doc)
+		n, _, _ := db.Insert(doc)
 		docs += n
 	}
 
@@ -70,3 +72,157 @@ func TestNewPreInsertIndex(t *testing.T) {
 
 	assert.Equal(t, db.GetIndex("Name").Count, 1000, "index contains 1000 documents")
 }
+
+func TestIndexFindsEveryDocument(t *testing.T) {
+	db := NewDatabase()
+	db.NewIndex("Name")
+
+	for i := 0; i < 20000; i++ {
+		db.Insert(&TestDoc{
+			Name: "Test document " + strconv.Itoa(i),
+			Age:  i,
+		})
+	}
+
+	for i := 0; i < 20000; i++ {
+		n, _ := db.Find(&struct{ Name string }{Name: "Test document " + strconv.Itoa(i)}, 0, 10)
+		if !assert.Equal(t, n, 1, "document %d found through index", i) {
+			break
+		}
+	}
+
+	n, _ := db.Find(&struct{ Name string }{Name: "Test document 20000"}, 0, 10)
+	assert.Equal(t, n, 0, "no results for invalid name")
+}
+
+func TestOrderedIndexRange(t *testing.T) {
+	db := NewDatabase()
+	err := db.NewIndexWithOptions([]string{"Age"}, Ordered())
+	assert.Nil(t, err, "no error creating index")
+	err = db.NewIndexWithOptions([]string{"Name", "Age"}, Ordered())
+	assert.Nil(t, err, "no error creating index")
+
+	for i := 0; i < 1000; i++ {
+		db.Insert(&TestDoc{
+			Name: "Test document " + strconv.Itoa(i%100),
+			Age:  i % 60,
+		})
+	}
+	assert.Equal(t, db.GetIndex("Age").Ordered, true, "index is ordered")
+
+	n, docs := db.Find(&struct{ Age Q }{Age: Gt(50)}, 0, 0)
+	assert.Equal(t, n, 144, "144 documents older than 50")
+	last := 0
+	for _, doc := range docs {
+		var d TestDoc
+		doc.Unmarshal(&d)
+		assert.True(t, d.Age > 50, "age is greater than 50")
+		assert.True(t, d.Age >= last, "results are in index order")
+		last = d.Age
+	}
+
+	n, _ = db.Find(&struct{ Age Q }{Age: Q{"$gte": 10, "$lt": 20}}, 0, 0)
+	assert.Equal(t, n, 170, "170 documents aged 10 to 19")
+
+	n, _ = db.Find(&struct{ Age Q }{Age: Lte(int64(-1))}, 0, 0)
+	assert.Equal(t, n, 0, "no documents with negative age")
+
+	n, _ = db.Find(&struct{ Name Q }{Name: Prefix("Test document 9")}, 0, 0)
+	assert.Equal(t, n, 110, "110 documents with names starting Test document 9")
+
+	n, docs = db.Find(&struct {
+		Name string
+		Age  Q
+	}{Name: "Test document 5", Age: Gte(30)}, 0, 0)
+	assert.Equal(t, n, 3, "3 documents with name and age range")
+	for _, doc := range docs {
+		var d TestDoc
+		doc.Unmarshal(&d)
+		assert.Equal(t, d.Name, "Test document 5")
+		assert.True(t, d.Age >= 30, "age is at least 30")
+	}
+
+	n, _ = db.Find(&struct{ Name string }{Name: "Test document 5"}, 0, 0)
+	assert.Equal(t, n, 10, "exact lookups still work on an ordered index")
+}
+
+func TestOrderedKeyNumbers(t *testing.T) {
+	// ascending, with equal values of different types grouped
+	groups := [][]interface{}{
+		{math.MinInt64, float64(math.MinInt64)},
+		{-1 << 53, float64(-1 << 53)},
+		{-1.5},
+		{-1, int8(-1), -1.0},
+		{0, math.Copysign(0, -1), uint8(0), float32(0)},
+		{0.5},
+		{1, 1.0, float32(1), uint(1)},
+		{float64(1 << 53), int64(1 << 53)},
+		{1<<53 + 1, uint64(1<<53 + 1)},
+		{int64(math.MaxInt64)},
+		{float64(1 << 63), uint64(1 << 63)},
+		{uint64(math.MaxUint64)},
+		{math.Inf(1)},
+	}
+
+	idx := newIndex(nil, []string{"A"}, Ordered())
+	for i, ga := range groups {
+		for _, a := range ga {
+			for j, gb := range groups {
+				for _, b := range gb {
+					c := bytes.Compare(appendKey(nil, a), appendKey(nil, b))
+					assert.True(t, (c < 0) == (i < j) && (c == 0) == (i == j), "keys of %T %v and %T %v are in value order", a, a, b, b)
+				}
+			}
+
+			values, ok := idx.keyValues(idx.Key(map[string]interface{}{"A": a}))
+			assert.True(t, ok, "key of %T %v decodes", a, a)
+			assert.Equal(t, values["A"], a, "key of %T %v decodes to its type", a, a)
+		}
+	}
+}
+
+func TestMultikeyIndex(t *testing.T) {
+	for _, opts := range [][]IndexOption{nil, {Ordered()}} {
+		db := NewDatabase()
+		db.NewIndexWithOptions([]string{"Tags"}, opts...)
+		db.NewIndexWithOptions([]string{"Address.City"}, opts...)
+
+		for i := 0; i < 100; i++ {
+			db.Insert(&TestPerson{
+				Name:    "Test person " + strconv.Itoa(i),
+				Address: TestAddress{City: "City " + strconv.Itoa(i%10)},
+				Tags:    []string{"tag" + strconv.Itoa(i%3), "tag" + strconv.Itoa(i%5), "all"},
+			})
+		}
+
+		idx := db.GetIndex("Tags")
+		assert.True(t, idx.Multikey, "slice field makes a multikey index")
+		assert.False(t, db.GetIndex("Address.City").Multikey)
+
+		n, docs := db.Find(Q{"Tags": "all"}, 0, 0)
+		assert.Equal(t, n, 100, "every document is under a shared element")
+		assert.Equal(t, len(uniqueDocs(docs)), 100, "documents aren't repeated")
+
+		// i%3 == 1 or i%5 == 1
+		n, _ = db.Find(Q{"Tags": In("tag1")}, 0, 0)
+		assert.Equal(t, n, 46)
+		n, _ = db.Find(Q{"Tags": In("tag1", "tag4")}, 0, 0)
+		assert.Equal(t, n, 59)
+		n, _ = db.Find(Q{"Address.City": "City 3", "Tags": "tag0"}, 0, 0)
+		assert.Equal(t, n, 4)
+
+		p := db.Explain(Q{"Tags": "tag2"}, FindOptions{})
+		assert.Equal(t, p.Index, "Tags", "multikey index is used")
+
+		// removing an element unindexes the document from its leaf
+		db.Update(Q{"Name": "Test person 1"}, &TestPerson{Name: "Test person 1", Tags: []string{"all"}})
+		n, _ = db.Find(Q{"Tags": "tag1"}, 0, 0)
+		assert.Equal(t, n, 45, "updated document is removed")
+		n, _ = db.Find(Q{"Tags": "all"}, 0, 0)
+		assert.Equal(t, n, 100, "updated document is still indexed")
+
+		db.Delete(Q{"Tags": "tag0"}, 0)
+		n, _ = db.Find(Q{"Tags": "all"}, 0, 0)
+		assert.Equal(t, n, 53, "deleted documents are removed from every leaf")
+	}
+}
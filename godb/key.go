@@ -0,0 +1,293 @@
+package godb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"time"
+)
+
+// Key type tags for the order-preserving encoding used by ordered
+// indexes. Values of different types sort by tag.
+const (
+	keyNil    byte = 0x05
+	keyNumber byte = 0x10
+	keyString byte = 0x20
+	keyBytes  byte = 0x30
+	keyBool   byte = 0x40
+	keyTime   byte = 0x50
+	keyOther  byte = 0xf0
+)
+
+// appendKey appends the order-preserving encoding of v. Encodings are
+// prefix-free, so the keys of a compound index can be concatenated and
+// still sort field by field.
+//
+// Numbers of every type are encoded by value alone, so equal numbers of
+// different types share an encoding and the next field of a compound
+// key orders them: the nearest float64, then the difference between it
+// and an integer value it can't hold exactly. An ordered index key ends
+// with the kinds of its numbers (see appendKinds), so they decode to
+// their own types.
+func appendKey(b []byte, v interface{}) []byte {
+	if bv, ok := basicValue(reflect.ValueOf(v)); ok {
+		v = bv
+	}
+	switch v := v.(type) {
+	case nil:
+		return append(b, keyNil)
+	case string:
+		return appendEscaped(append(b, keyString), []byte(v))
+	case []byte:
+		return appendEscaped(append(b, keyBytes), v)
+	case bool:
+		if v {
+			return append(b, keyBool, 1)
+		}
+		return append(b, keyBool, 0)
+	case time.Time:
+		var buf [12]byte
+		binary.BigEndian.PutUint64(buf[0:8], uint64(v.Unix())^(1<<63))
+		binary.BigEndian.PutUint32(buf[8:12], uint32(v.Nanosecond()))
+		return append(append(b, keyTime), buf[:]...)
+	}
+
+	rv := reflect.ValueOf(v)
+	var f float64
+	var delta int64
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i := rv.Int()
+		if i >= 0 {
+			f, delta = uintKey(uint64(i))
+			break
+		}
+		// float64(i) is at least -2^63, so converts back exactly
+		f = float64(i)
+		delta = i - int64(f)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		f, delta = uintKey(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		f = rv.Float()
+		if f == 0 {
+			// -0 equals 0
+			f = 0
+		}
+	default:
+		// other types aren't ordered, but are kept distinct by their
+		// canonical encoding
+		return appendEscaped(append(b, keyOther), appendHashValue(nil, v))
+	}
+
+	var buf [8]byte
+	b = appendFloatKey(append(b, keyNumber), f)
+	binary.BigEndian.PutUint64(buf[:], uint64(delta)^(1<<63))
+	return append(b, buf[:]...)
+}
+
+// uintKey returns the nearest float64 to u and the difference between
+// them. 2^64 is taken as 0 when subtracting, as u can round up to it.
+func uintKey(u uint64) (float64, int64) {
+	f := float64(u)
+	if f >= 1<<64 {
+		return f, int64(u)
+	}
+	return f, int64(u - uint64(f))
+}
+
+// appendKinds appends the kind of each number in values. Ordered index
+// keys end with them, after every field, so that a number's type keeps
+// equal values of different types distinct without changing the order
+// of the values.
+func appendKinds(b []byte, values []interface{}) []byte {
+	for _, v := range values {
+		if isNumber(v) {
+			b = append(b, byte(reflect.ValueOf(v).Kind()))
+		}
+	}
+	return b
+}
+
+func appendFloatKey(b []byte, f float64) []byte {
+	bits := math.Float64bits(f)
+	if bits&(1<<63) == 0 {
+		bits ^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], bits)
+	return append(b, buf[:]...)
+}
+
+// appendEscaped writes v with zero bytes escaped as 0x00 0xff, then a
+// 0x00 terminator
+func appendEscaped(b []byte, v []byte) []byte {
+	return append(appendEscapedPrefix(b, v), 0x00)
+}
+
+func appendEscapedPrefix(b []byte, v []byte) []byte {
+	for _, c := range v {
+		if c == 0x00 {
+			b = append(b, 0x00, 0xff)
+			continue
+		}
+		b = append(b, c)
+	}
+	return b
+}
+
+// keyTag returns the type tag v is encoded with
+func keyTag(v interface{}) byte {
+	return appendKey(nil, v)[0]
+}
+
+// keyRange is an inclusive range of keys. Lo is nil when there's no
+// lower bound and Hi nil when there's no upper bound; keys which have
+// Hi as a prefix are within the range.
+type keyRange struct {
+	Lo []byte
+	Hi []byte
+}
+
+func (r keyRange) contains(k []byte) bool {
+	if r.Lo != nil && bytes.Compare(k, r.Lo) < 0 {
+		return false
+	}
+	if r.Hi != nil && bytes.Compare(k, r.Hi) > 0 && !bytes.HasPrefix(k, r.Hi) {
+		return false
+	}
+	return true
+}
+
+// mayContain reports whether any key starting with prefix could be in
+// the range
+func (r keyRange) mayContain(prefix []byte) bool {
+	if r.Lo != nil {
+		m := len(prefix)
+		if len(r.Lo) < m {
+			m = len(r.Lo)
+		}
+		if bytes.Compare(prefix[:m], r.Lo[:m]) < 0 {
+			return false
+		}
+	}
+	if r.Hi != nil {
+		m := len(prefix)
+		if len(r.Hi) < m {
+			m = len(r.Hi)
+		}
+		if bytes.Compare(prefix[:m], r.Hi[:m]) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// numberKey is a number read from a key, before its kind is known
+type numberKey struct {
+	f     float64
+	delta int64
+}
+
+// decodeKey reads one value written by appendKey, with numbers read as
+// a numberKey for decodeNumber. The second result is false for values
+// the key doesn't hold exactly, which are times (whose location isn't
+// kept), nils (which may be missing fields) and other types; the caller
+// must read the document instead.
+func decodeKey(b []byte) (interface{}, []byte, bool) {
+	if len(b) == 0 {
+		return nil, b, false
+	}
+	switch b[0] {
+	case keyString:
+		v, rest, ok := decodeEscaped(b[1:])
+		return string(v), rest, ok
+	case keyBytes:
+		return decodeEscaped(b[1:])
+	case keyBool:
+		if len(b) < 2 {
+			return nil, b, false
+		}
+		return b[1] == 1, b[2:], true
+	case keyNumber:
+		if len(b) < 17 {
+			return nil, b, false
+		}
+		bits := binary.BigEndian.Uint64(b[1:9])
+		if bits&(1<<63) != 0 {
+			bits ^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		delta := int64(binary.BigEndian.Uint64(b[9:17]) ^ (1 << 63))
+		return numberKey{f: math.Float64frombits(bits), delta: delta}, b[17:], true
+	}
+	return nil, b, false
+}
+
+func decodeEscaped(b []byte) ([]byte, []byte, bool) {
+	v := make([]byte, 0)
+	for i := 0; i < len(b); i++ {
+		if b[i] != 0x00 {
+			v = append(v, b[i])
+			continue
+		}
+		if i+1 < len(b) && b[i+1] == 0xff {
+			v = append(v, 0x00)
+			i++
+			continue
+		}
+		return v, b[i+1:], true
+	}
+	return nil, b, false
+}
+
+// decodeNumber returns the number read from a key as the kind it was
+// written from
+func decodeNumber(n numberKey, kind reflect.Kind) (interface{}, bool) {
+	switch kind {
+	case reflect.Float32:
+		return float32(n.f), true
+	case reflect.Float64:
+		return n.f, true
+	}
+
+	// the inverse of appendKey's integer encodings
+	var u uint64
+	switch {
+	case n.f >= 1<<64:
+		u = uint64(n.delta)
+	case n.f >= 0:
+		u = uint64(n.f) + uint64(n.delta)
+	default:
+		u = uint64(int64(n.f) + n.delta)
+	}
+	i := int64(u)
+	switch kind {
+	case reflect.Int:
+		return int(i), true
+	case reflect.Int8:
+		return int8(i), true
+	case reflect.Int16:
+		return int16(i), true
+	case reflect.Int32:
+		return int32(i), true
+	case reflect.Int64:
+		return i, true
+	case reflect.Uint:
+		return uint(u), true
+	case reflect.Uint8:
+		return uint8(u), true
+	case reflect.Uint16:
+		return uint16(u), true
+	case reflect.Uint32:
+		return uint32(u), true
+	case reflect.Uint64:
+		return u, true
+	case reflect.Uintptr:
+		return uintptr(u), true
+	}
+	return nil, false
+}
@@ -1,13 +1,130 @@
 package godb
 
 import (
+	"crypto/md5"
 	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
 )
 
+var ErrInvalidObjectID = errors.New("Invalid ObjectID")
+
+// ObjectID is a 12 byte document identifier laid out like MongoDB's: a
+// 4 byte big-endian Unix timestamp, a 3 byte machine id, a 2 byte
+// process id and a 3 byte counter. IDs generated by one process sort in
+// creation order.
 type ObjectID []byte
 
-func NewObjectID() []byte {
-	uuid := make([]byte, 16)
-	rand.Read(uuid)
-	return uuid
+var objectIDMachine = machineID()
+
+// the timestamp and counter of the last ObjectID, guarded by
+// objectIDLock. The counter starts at a random value, and when it wraps
+// the timestamp is carried forward so IDs keep increasing.
+var objectIDLock = new(sync.Mutex)
+var objectIDTime uint32
+var objectIDCounter = randomCounter() & 0xffffff
+
+func machineID() []byte {
+	id := make([]byte, 3)
+	hostname, err := os.Hostname()
+	if err != nil {
+		rand.Read(id)
+		return id
+	}
+	sum := md5.Sum([]byte(hostname))
+	copy(id, sum[:])
+	return id
+}
+
+func randomCounter() uint32 {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return binary.BigEndian.Uint32(b)
+}
+
+func NewObjectID() ObjectID {
+	ts, i := nextObjectIDStamp()
+	id := make([]byte, 12)
+	binary.BigEndian.PutUint32(id[0:4], ts)
+	copy(id[4:7], objectIDMachine)
+	pid := os.Getpid()
+	id[7] = byte(pid >> 8)
+	id[8] = byte(pid)
+	id[9] = byte(i >> 16)
+	id[10] = byte(i >> 8)
+	id[11] = byte(i)
+	return id
+}
+
+// nextObjectIDStamp returns the timestamp and counter for a new
+// ObjectID, greater than the last one's
+func nextObjectIDStamp() (uint32, uint32) {
+	objectIDLock.Lock()
+	defer objectIDLock.Unlock()
+
+	objectIDCounter++
+	if objectIDCounter > 0xffffff {
+		objectIDCounter = 0
+		objectIDTime++
+	}
+	if now := uint32(time.Now().Unix()); now > objectIDTime {
+		objectIDTime = now
+	}
+	return objectIDTime, objectIDCounter
+}
+
+// ParseObjectID parses the hex form of an ObjectID
+func ParseObjectID(s string) (ObjectID, error) {
+	if len(s) != 24 {
+		return nil, ErrInvalidObjectID
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidObjectID
+	}
+	return b, nil
+}
+
+// Time returns the creation time embedded in the ObjectID
+func (id ObjectID) Time() time.Time {
+	if len(id) < 4 {
+		return time.Time{}
+	}
+	return time.Unix(int64(binary.BigEndian.Uint32(id[0:4])), 0)
+}
+
+func (id ObjectID) Hex() string {
+	return hex.EncodeToString(id)
+}
+
+func (id ObjectID) String() string {
+	return id.Hex()
+}
+
+func (id ObjectID) MarshalJSON() ([]byte, error) {
+	return json.Marshal(id.Hex())
+}
+
+// UnmarshalJSON parses the hex form of an ObjectID. An empty string or
+// null, as a nil ObjectID is marshalled, is a nil ObjectID.
+func (id *ObjectID) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if s == "" {
+		*id = nil
+		return nil
+	}
+	parsed, err := ParseObjectID(s)
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
 }
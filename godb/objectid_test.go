@@ -0,0 +1,73 @@
+package godb
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestNewObjectID(t *testing.T) {
+	before := time.Now().Add(-time.Second)
+	id := NewObjectID()
+	after := time.Now().Add(time.Second)
+
+	assert.Equal(t, len(id), 12, "object id is 12 bytes")
+	assert.True(t, id.Time().After(before) && id.Time().Before(after), "object id contains creation time")
+
+	prev := id
+	for i := 0; i < 1000; i++ {
+		next := NewObjectID()
+		if !assert.True(t, bytes.Compare(prev, next) < 0, "object ids sort in creation order") {
+			break
+		}
+		prev = next
+	}
+
+	objectIDLock.Lock()
+	objectIDCounter = 0xffffff
+	objectIDLock.Unlock()
+	next := NewObjectID()
+	assert.True(t, bytes.Compare(prev, next) < 0, "object ids sort in creation order when the counter wraps")
+}
+
+func TestParseObjectID(t *testing.T) {
+	id := NewObjectID()
+
+	parsed, err := ParseObjectID(id.Hex())
+	assert.Nil(t, err, "no error parsing hex")
+	assert.Equal(t, parsed, id, "parsed object id matches")
+	assert.Equal(t, id.String(), id.Hex(), "string form is hex")
+
+	_, err = ParseObjectID("not an object id")
+	assert.Equal(t, err, ErrInvalidObjectID)
+	_, err = ParseObjectID("zzzzzzzzzzzzzzzzzzzzzzzz")
+	assert.Equal(t, err, ErrInvalidObjectID)
+}
+
+func TestObjectIDJSON(t *testing.T) {
+	doc := TestDocWithID{ID: NewObjectID(), Name: "Test document 1"}
+
+	b, err := json.Marshal(&doc)
+	assert.Nil(t, err, "no error marshalling")
+	assert.Contains(t, string(b), `"ID":"`+doc.ID.Hex()+`"`)
+
+	var d TestDocWithID
+	err = json.Unmarshal(b, &d)
+	assert.Nil(t, err, "no error unmarshalling")
+	assert.Equal(t, d.ID, doc.ID, "object id round trips")
+
+	err = json.Unmarshal([]byte(`{"ID":"bad"}`), &d)
+	assert.Equal(t, err, ErrInvalidObjectID)
+
+	b, err = json.Marshal(&TestDocWithID{})
+	assert.Nil(t, err, "no error marshalling a nil object id")
+	d = TestDocWithID{ID: NewObjectID()}
+	err = json.Unmarshal(b, &d)
+	assert.Nil(t, err, "no error unmarshalling a nil object id")
+	assert.Nil(t, d.ID, "nil object id round trips")
+
+	err = json.Unmarshal([]byte(`{"ID":null}`), &d)
+	assert.Nil(t, err, "no error unmarshalling null")
+}
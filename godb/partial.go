@@ -0,0 +1,180 @@
+package godb
+
+// includes reports whether a document is held by the index: a sparse
+// index skips documents with none of its fields, and a partial index
+// documents not matching its filter
+func (idx *Index) includes(d *Document, values map[string]interface{}) bool {
+	if idx.Filter != nil && !matchFields(d, values, idx.Filter) {
+		return false
+	}
+	if !idx.Sparse {
+		return true
+	}
+	for _, f := range idx.Fields {
+		if _, ok := lookupPath(values, f); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// usableFor reports whether the index holds every document which can
+// match the query. A sparse index needs a query which can't match a
+// document missing one of its fields, and a partial index a query
+// which implies its filter.
+func (idx *Index) usableFor(fields map[string]interface{}) bool {
+	if !idx.Sparse && idx.Filter == nil {
+		return true
+	}
+
+	pf := planFields(fields)
+	if idx.Sparse {
+		required := false
+		for _, f := range idx.Fields {
+			if cond, ok := pf[f]; ok && !matchValue(nil, false, cond) {
+				required = true
+				break
+			}
+		}
+		if !required {
+			return false
+		}
+	}
+
+	for fn, fc := range idx.Filter {
+		cond, ok := pf[fn]
+		if !ok || !implies(cond, fc) {
+			return false
+		}
+	}
+	return true
+}
+
+// implies reports whether every value matching the query condition
+// matches the filter condition. It only recognises simple cases, exact
+// values and $in lists which match the filter, and range bounds within
+// the filter's, and is false otherwise.
+func implies(cond, filter interface{}) bool {
+	if values, ok := exactValues(cond); ok {
+		for _, v := range values {
+			if !matchValue(v, true, filter) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if !isOperator(cond) || !isOperator(filter) {
+		return false
+	}
+	for op, arg := range filter.(Q) {
+		switch op {
+		case "$exists":
+			if arg != true || matchValue(nil, false, cond) {
+				return false
+			}
+		case "$gt", "$gte", "$lt", "$lte":
+			if !impliesBound(cond.(Q), op, arg) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// exactValues returns the values a condition allows, if it's an exact
+// value or an $in list
+func exactValues(cond interface{}) ([]interface{}, bool) {
+	if !isOperator(cond) {
+		return []interface{}{cond}, true
+	}
+	q := cond.(Q)
+	if in, ok := q["$in"]; ok && len(q) == 1 {
+		return valueList(in), true
+	}
+	return nil, false
+}
+
+// impliesBound reports whether the query has a bound on the same side
+// as the filter's op and at least as tight
+func impliesBound(q Q, op string, bound interface{}) bool {
+	lower := op == "$gt" || op == "$gte"
+	for qop, qb := range q {
+		switch qop {
+		case "$gt", "$gte":
+			if !lower {
+				continue
+			}
+		case "$lt", "$lte":
+			if lower {
+				continue
+			}
+		default:
+			continue
+		}
+
+		c, ok := compareValues(qb, bound)
+		if !ok {
+			continue
+		}
+		if !lower {
+			c = -c
+		}
+		// an exclusive filter bound needs an exclusive query bound
+		// at the same value
+		if c > 0 || (c == 0 && (op == "$gte" || op == "$lte" || qop == op)) {
+			return true
+		}
+	}
+	return false
+}
+
+// storedFilter converts a partial index filter to plain maps and slices,
+// so it can be logged
+func storedFilter(v interface{}) interface{} {
+	switch v := v.(type) {
+	case Q:
+		return storedFilter(map[string]interface{}(v))
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = storedFilter(e)
+		}
+		return m
+	case []Q:
+		s := make([]interface{}, len(v))
+		for i, e := range v {
+			s[i] = storedFilter(e)
+		}
+		return s
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, e := range v {
+			s[i] = storedFilter(e)
+		}
+		return s
+	}
+	return v
+}
+
+// loadedFilter converts a logged filter back to a query, with its maps
+// as Q
+func loadedFilter(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		q := make(Q, len(v))
+		for k, e := range v {
+			q[k] = loadedFilter(e)
+		}
+		return q
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, e := range v {
+			s[i] = loadedFilter(e)
+		}
+		return s
+	}
+	return v
+}
@@ -0,0 +1,104 @@
+package godb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestSparseIndex(t *testing.T) {
+	db := NewDatabase()
+	db.NewIndexWithOptions([]string{"Nickname"}, Sparse())
+	for i := 0; i < 100; i++ {
+		doc := map[string]interface{}{"Name": "Test person " + strconv.Itoa(i)}
+		if i%10 == 0 {
+			doc["Nickname"] = "Nick " + strconv.Itoa(i%20)
+		}
+		db.Insert(doc)
+	}
+
+	idx := db.GetIndex("Nickname")
+	assert.Equal(t, idx.Count, 10, "documents without the field aren't indexed")
+
+	n, _ := db.Find(Q{"Nickname": "Nick 10"}, 0, 0)
+	assert.Equal(t, n, 5)
+	assert.Equal(t, db.Explain(Q{"Nickname": "Nick 10"}, FindOptions{}).Index, "Nickname", "sparse index is used")
+
+	n, _ = db.Find(Q{"Nickname": nil}, 0, 0)
+	assert.Equal(t, n, 90, "missing fields are found without the index")
+	assert.Equal(t, db.Explain(Q{"Nickname": nil}, FindOptions{}).Strategy, "scan")
+	n, _ = db.Find(Q{"Nickname": Nin("Nick 0")}, 0, 0)
+	assert.Equal(t, n, 95)
+	assert.Equal(t, db.Distinct("Nickname", Q{"Nickname": Exists(false)}), []interface{}{})
+
+	db.Update(Q{"Nickname": "Nick 0"}, map[string]interface{}{"Nickname": nil})
+	assert.Equal(t, idx.Count, 10, "nil values are indexed")
+	assert.Nil(t, db.Verify(), "index is consistent")
+}
+
+func TestPartialIndex(t *testing.T) {
+	scan := NewDatabase()
+	indexed := NewDatabase()
+	indexed.NewIndexWithOptions([]string{"Name"}, PartialFilter(Q{"Age": Gte(18)}))
+	for i := 0; i < 100; i++ {
+		doc := &TestDoc{Name: "Test document " + strconv.Itoa(i%10), Age: i % 30}
+		scan.Insert(doc)
+		indexed.Insert(doc)
+	}
+
+	idx := indexed.GetIndex("Name")
+	assert.Equal(t, idx.Count, 36, "documents not matching the filter aren't indexed")
+
+	tests := []struct {
+		query  Q
+		usable bool
+	}{
+		{Q{"Name": "Test document 1", "Age": 21}, true},
+		{Q{"Name": "Test document 1", "Age": In(18, 21)}, true},
+		{Q{"Name": "Test document 1", "Age": Gte(18)}, true},
+		{Q{"Name": "Test document 1", "Age": Gt(18)}, true},
+		{Q{"Name": "Test document 1", "Age": Q{"$gte": 20, "$lt": 25}}, true},
+		{Q{"Name": "Test document 1", "$and": []Q{{"Age": Gt(20)}}}, true},
+		{Q{"Name": "Test document 1"}, false},
+		{Q{"Name": "Test document 1", "Age": 11}, false},
+		{Q{"Name": "Test document 1", "Age": In(11, 21)}, false},
+		{Q{"Name": "Test document 1", "Age": Gt(17)}, false},
+		{Q{"Name": "Test document 1", "Age": Lt(25)}, false},
+		{Q{"Name": "Test document 1", "Age": Ne(5)}, false},
+	}
+	for _, test := range tests {
+		n, _ := scan.Find(test.query, 0, 0)
+		n2, _ := indexed.Find(test.query, 0, 0)
+		assert.Equal(t, n2, n, "index finds the same documents as a scan for %v", test.query)
+		assert.Equal(t, indexed.Explain(test.query, FindOptions{}).Index == "Name", test.usable, "index use for %v", test.query)
+		assert.Equal(t, indexed.Count(test.query), n, "count for %v", test.query)
+	}
+
+	indexed.Update(Q{"Name": "Test document 1", "Age": 21}, &struct{ Age int }{Age: 5})
+	assert.Equal(t, idx.Count, 33, "documents leaving the filter are removed")
+	indexed.Update(Q{"Name": "Test document 2", "Age": 2}, &struct{ Age int }{Age: 25})
+	assert.Equal(t, idx.Count, 37, "documents entering the filter are added")
+	assert.Nil(t, indexed.Verify(), "index is consistent")
+}
+
+func TestPartialIndexIsLogged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godb.wal")
+	db, err := Open(path)
+	assert.Nil(t, err, "no error opening database")
+	err = db.NewIndexWithOptions([]string{"Name"}, Sparse(), PartialFilter(Q{"Age": Q{"$gte": 18, "$lt": 65}}))
+	assert.Nil(t, err, "no error creating index")
+	db.Insert(&TestDoc{Name: "a", Age: 20}, &TestDoc{Name: "b", Age: 10})
+	assert.Nil(t, db.Close(), "no error closing database")
+
+	db, err = Open(path)
+	assert.Nil(t, err, "no error reopening database")
+	defer db.Close()
+	idx := db.GetIndex("Name")
+	if assert.NotNil(t, idx, "index is rebuilt") {
+		assert.True(t, idx.Sparse, "sparse option survives replay")
+		assert.Equal(t, idx.Filter, Q{"Age": Q{"$gte": 18, "$lt": 65}}, "filter survives replay")
+		assert.Equal(t, idx.Count, 1, "filter is applied")
+		assert.Equal(t, db.Explain(Q{"Name": "a", "Age": 30}, FindOptions{}).Index, "Name", "restored filter is used")
+	}
+}
@@ -0,0 +1,339 @@
+package godb
+
+import (
+	"github.com/ian-kent/go-log/log"
+	"sort"
+	"strings"
+)
+
+// maxIndexLookups caps the number of point lookups an $in query is
+// expanded to before the planner prefers another plan
+const maxIndexLookups = 256
+
+// indexPlan is one way of finding candidates with an index, either by
+// point lookups or by walking a range of an ordered index
+type indexPlan struct {
+	idx *Index
+	// the query fields the plan constrains
+	fields  []string
+	lookups []map[string]interface{}
+	r       keyRange
+}
+
+// docs returns the plan's candidates, counting the leaves visited in
+// plan
+func (p *indexPlan) docs(plan *Plan) []*Document {
+	docs := make([]*Document, 0)
+	if p.lookups != nil {
+		seen := make(map[*Leaf]bool)
+		for _, l := range p.lookups {
+			if leaf := p.idx.FindLeaf(l); leaf != nil && !seen[leaf] {
+				plan.leaf()
+				seen[leaf] = true
+				docs = append(docs, leaf.Documents...)
+			}
+		}
+	} else {
+		p.idx.Tree.Walk(p.r, func(l *Leaf) bool {
+			plan.leaf()
+			docs = append(docs, l.Documents...)
+			return true
+		})
+	}
+
+	if p.idx.Multikey {
+		// a document is in a leaf for each of its elements
+		docs = uniqueDocs(docs)
+	}
+	return docs
+}
+
+// better reports whether p is preferred to q: plans constraining more
+// fields first, then point lookups over range scans, then by name so
+// that the choice doesn't depend on map order
+func (p *indexPlan) better(q *indexPlan) bool {
+	if len(p.fields) != len(q.fields) {
+		return len(p.fields) > len(q.fields)
+	}
+	if (p.lookups != nil) != (q.lookups != nil) {
+		return p.lookups != nil
+	}
+	return p.idx.Name < q.idx.Name
+}
+
+// candidates returns the documents which may match the query, using the
+// ObjectID map or an index where one applies. If exact is true every
+// candidate is known to match and needn't be checked. The caller must
+// hold a lock.
+func (db *Database) candidates(fields map[string]interface{}) (docs []*Document, exact bool) {
+	return db.plannedCandidates(fields, nil)
+}
+
+// plannedCandidates is candidates, recording the choices made in p if
+// it isn't nil
+func (db *Database) plannedCandidates(fields map[string]interface{}, p *Plan) (docs []*Document, exact bool) {
+	defer func() {
+		p.candidates(len(docs))
+	}()
+
+	if id, ok := fields[idField].(ObjectID); ok {
+		p.strategy("id", nil)
+		docs = make([]*Document, 0)
+		if doc := db.findByID(id); doc != nil {
+			docs = append(docs, doc)
+		}
+		return docs, false
+	}
+
+	if len(fields) == 0 {
+		p.strategy("scan", nil)
+		return db.Documents, true
+	}
+
+	if !hasOperators(fields) {
+		if idx := db.exactIndex(fields); idx != nil {
+			log.Trace("Using index %s", idx.Name)
+			p.strategy("exact index", idx)
+			p.consider(idx)
+			l := idx.FindLeaf(fields)
+			if l == nil {
+				return make([]*Document, 0), true
+			}
+			p.leaf()
+			return l.Documents, !l.Collided
+		}
+	}
+
+	if docs, ok := db.indexCandidates(fields, p); ok {
+		return docs, false
+	}
+
+	log.Trace("Scanning full database")
+	p.strategy("scan", nil)
+	return db.Documents, false
+}
+
+// exactIndex returns the index on exactly the query's fields, in any
+// order, if its leaves hold only documents with the queried values
+func (db *Database) exactIndex(fields map[string]interface{}) *Index {
+	var best *Index
+	for _, idx := range db.Indexes {
+		if len(idx.Fields) != len(fields) || (best != nil && idx.Name > best.Name) || !idx.usableFor(fields) {
+			continue
+		}
+		if _, ok := idx.lookups(fields); ok {
+			best = idx
+		}
+	}
+	return best
+}
+
+// hasOperators reports whether the query uses any operators rather
+// than only exact field values
+func hasOperators(fields map[string]interface{}) bool {
+	for fn, f := range fields {
+		if strings.HasPrefix(fn, "$") || isOperator(f) {
+			return true
+		}
+	}
+	return false
+}
+
+// indexCandidates returns a superset of the documents matching the
+// query from the best index for it, intersected with a second single
+// field index if that constrains another field. An $or is answered
+// with the union of its branches' candidates if every branch can use
+// an index.
+func (db *Database) indexCandidates(fields map[string]interface{}, p *Plan) ([]*Document, bool) {
+	plans := db.indexPlans(planFields(fields))
+	for _, ip := range plans {
+		p.consider(ip.idx)
+	}
+	if len(plans) > 0 {
+		best := plans[0]
+		log.Trace("Using index %s", best.idx.Name)
+		p.strategy("index", best.idx)
+		docs := best.docs(p)
+		if other := intersectPlan(best, plans[1:]); other != nil {
+			log.Trace("Intersecting with index %s", other.idx.Name)
+			p.strategy("intersection", best.idx)
+			if p != nil {
+				p.Intersect = other.idx.Name
+			}
+			docs = intersect(docs, other.docs(p))
+		}
+		return docs, true
+	}
+
+	or, ok := fields["$or"]
+	if !ok {
+		return nil, false
+	}
+	seen := make(map[*Document]bool)
+	docs := make([]*Document, 0)
+	for _, q := range subQueries(or) {
+		branch, ok := db.indexCandidates(q, p)
+		if !ok {
+			return nil, false
+		}
+		for _, d := range branch {
+			if !seen[d] {
+				seen[d] = true
+				docs = append(docs, d)
+			}
+		}
+	}
+	log.Trace("Using union of %d indexed $or branches", len(subQueries(or)))
+	p.strategy("union", nil)
+	if p != nil {
+		p.Index = ""
+	}
+	return docs, true
+}
+
+// planFields returns the field conditions every matching document must
+// satisfy, for choosing an index. Conditions inside an $and are lifted
+// out and single $eq conditions become exact values.
+func planFields(fields map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{})
+	for fn, f := range fields {
+		if fn == "$and" {
+			for _, q := range subQueries(f) {
+				for k, v := range planFields(q) {
+					if _, ok := out[k]; !ok {
+						out[k] = v
+					}
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(fn, "$") {
+			continue
+		}
+		if q, ok := f.(Q); ok && len(q) == 1 {
+			if v, ok := q["$eq"]; ok && !isOperator(v) {
+				f = v
+			}
+		}
+		out[fn] = f
+	}
+	return out
+}
+
+// indexPlans returns a plan for every index which can narrow the query,
+// best first. An index whose fields all have exact or $in values in
+// the query is used for point lookups, so a compound index can answer
+// part of a query and leave the rest to the filter. An ordered index
+// can also be walked for a range of its leading fields.
+func (db *Database) indexPlans(fields map[string]interface{}) []*indexPlan {
+	plans := make([]*indexPlan, 0)
+	for _, idx := range db.Indexes {
+		if !idx.usableFor(fields) {
+			continue
+		}
+		if lookups, ok := idx.lookups(fields); ok {
+			plans = append(plans, &indexPlan{idx: idx, fields: idx.Fields, lookups: lookups})
+			continue
+		}
+		if !idx.Ordered {
+			continue
+		}
+		if r, n, ok := idx.queryRange(fields); ok {
+			plans = append(plans, &indexPlan{idx: idx, fields: idx.Fields[:n], r: r})
+		}
+	}
+
+	sort.Slice(plans, func(i, j int) bool {
+		return plans[i].better(plans[j])
+	})
+	return plans
+}
+
+// intersectPlan returns the plan to intersect with best, if both are on
+// single field indexes and the other constrains a different field
+func intersectPlan(best *indexPlan, plans []*indexPlan) *indexPlan {
+	if len(best.idx.Fields) != 1 {
+		return nil
+	}
+	for _, p := range plans {
+		if len(p.idx.Fields) == 1 && p.idx.Fields[0] != best.idx.Fields[0] {
+			return p
+		}
+	}
+	return nil
+}
+
+// intersect returns the documents in both a and b, in the order of a
+func intersect(a, b []*Document) []*Document {
+	inB := make(map[*Document]bool, len(b))
+	for _, d := range b {
+		inB[d] = true
+	}
+	docs := make([]*Document, 0)
+	for _, d := range a {
+		if inB[d] {
+			docs = append(docs, d)
+		}
+	}
+	return docs
+}
+
+// uniqueDocs returns the documents without repeats, in order
+func uniqueDocs(docs []*Document) []*Document {
+	seen := make(map[*Document]bool, len(docs))
+	out := make([]*Document, 0, len(docs))
+	for _, d := range docs {
+		if !seen[d] {
+			seen[d] = true
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// lookups expands the query into the exact field values to look up in
+// the index, one set per combination of $in values. It returns false if
+// any index field isn't constrained to exact values.
+func (idx *Index) lookups(fields map[string]interface{}) ([]map[string]interface{}, bool) {
+	lookups := []map[string]interface{}{make(map[string]interface{})}
+	for _, f := range idx.Fields {
+		cond, ok := fields[f]
+		if !ok {
+			return nil, false
+		}
+		values := []interface{}{cond}
+		if isOperator(cond) {
+			q := cond.(Q)
+			in, ok := q["$in"]
+			if !ok || len(q) != 1 {
+				return nil, false
+			}
+			values = valueList(in)
+		}
+		for _, v := range values {
+			// ordered keys distinguish number types, which equality
+			// doesn't, so numbers are left to a range scan. Slices
+			// are indexed by element so can't be looked up whole.
+			if isOperator(v) || isList(v) || (idx.Ordered && isNumber(v)) {
+				return nil, false
+			}
+		}
+		if len(lookups)*len(values) > maxIndexLookups {
+			return nil, false
+		}
+
+		next := make([]map[string]interface{}, 0, len(lookups)*len(values))
+		for _, l := range lookups {
+			for _, v := range values {
+				m := make(map[string]interface{}, len(l)+1)
+				for k, lv := range l {
+					m[k] = lv
+				}
+				m[f] = v
+				next = append(next, m)
+			}
+		}
+		lookups = next
+	}
+	return lookups, true
+}
@@ -0,0 +1,101 @@
+package godb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+)
+
+func TestPlannerNormalizesFieldOrder(t *testing.T) {
+	db := NewDatabase()
+	db.NewIndex("Name", "Age")
+	for i := 0; i < 1000; i++ {
+		db.Insert(&TestDoc{
+			Name: "Test document " + strconv.Itoa(i%100),
+			Age:  i % 7,
+		})
+	}
+
+	// map order is random, so try enough times to hit both orders
+	for i := 0; i < 20; i++ {
+		idx := db.exactIndex(Q{"Age": 3, "Name": "Test document 5"})
+		if assert.NotNil(t, idx, "compound index is found whatever the field order") {
+			assert.Equal(t, idx.Name, "Name-Age")
+		}
+	}
+
+	n, _ := db.Find(&struct {
+		Age  int
+		Name string
+	}{Age: 3, Name: "Test document 10"}, 0, 0)
+	assert.Equal(t, n, 2, "2 results from the compound index")
+}
+
+func TestPlannerChoosesIndex(t *testing.T) {
+	db := NewDatabase()
+	db.NewIndex("Name")
+	db.NewIndex("Age")
+	db.NewIndex("Name", "Age")
+	db.NewIndexWithOptions([]string{"Age", "Name"}, Ordered())
+
+	for i := 0; i < 1000; i++ {
+		db.Insert(&TestDoc{
+			Name: "Test document " + strconv.Itoa(i%100),
+			Age:  i % 7,
+		})
+	}
+
+	tests := []struct {
+		query  Q
+		index  string
+		fields int
+	}{
+		// full match, preferring lookups to a range
+		{Q{"Name": "Test document 5", "Age": In(1, 3)}, "Name-Age", 2},
+		// subset match, with the rest filtered, preferring an exact
+		// value to a range
+		{Q{"Name": "Test document 5", "Age": Gt(3)}, "Name", 1},
+		{Q{"Name": In("Test document 5", "Test document 6"), "Email": "x"}, "Name", 1},
+		// leading prefix of an ordered compound index
+		{Q{"Age": Gt(3)}, "Age-Name", 1},
+	}
+	for _, test := range tests {
+		plans := db.indexPlans(planFields(test.query))
+		if assert.True(t, len(plans) > 0, "an index is used for %v", test.query) {
+			assert.Equal(t, plans[0].idx.Name, test.index, "index for %v", test.query)
+			assert.Equal(t, len(plans[0].fields), test.fields, "fields constrained for %v", test.query)
+		}
+
+		n, _ := db.Find(test.query, 0, 0)
+		scan := 0
+		for _, d := range db.Documents {
+			if matchDocument(d, test.query) {
+				scan++
+			}
+		}
+		assert.Equal(t, n, scan, "indexed count matches a scan for %v", test.query)
+	}
+
+	assert.Equal(t, len(db.indexPlans(Q{"Email": "x"})), 0, "unindexed query scans")
+}
+
+func TestPlannerIntersectsIndexes(t *testing.T) {
+	db := NewDatabase()
+	db.NewIndex("Name")
+	db.NewIndexWithOptions([]string{"Age"}, Ordered())
+
+	for i := 0; i < 1000; i++ {
+		db.Insert(&TestDoc{
+			Name: "Test document " + strconv.Itoa(i%100),
+			Age:  i % 7,
+		})
+	}
+
+	query := Q{"Name": "Test document 5", "Age": Gte(5)}
+	docs, exact := db.candidates(query)
+	assert.False(t, exact, "intersection is filtered")
+	assert.Equal(t, len(docs), 3, "candidates are the intersection of both indexes")
+
+	n, _ := db.Find(query, 0, 0)
+	assert.Equal(t, n, 3, "3 results")
+}
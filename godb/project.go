@@ -0,0 +1,158 @@
+package godb
+
+import (
+	"github.com/ian-kent/go-log/log"
+	"sort"
+	"strings"
+)
+
+func (opts FindOptions) projected() bool {
+	return len(opts.Include) > 0 || len(opts.Exclude) > 0
+}
+
+// project returns a document holding only the fields selected by opts
+func project(d *Document, values map[string]interface{}, opts FindOptions) *Document {
+	fields := make(map[string]interface{})
+	if len(opts.Include) > 0 {
+		for _, f := range opts.Include {
+			if v, ok := values[f]; ok {
+				fields[f] = v
+			}
+		}
+	} else {
+		for f, v := range values {
+			fields[f] = v
+		}
+	}
+	for _, f := range opts.Exclude {
+		delete(fields, f)
+	}
+	return &Document{ObjectID: d.ObjectID, Fields: fields}
+}
+
+// queryFieldNames returns the names of the fields a query reads
+func queryFieldNames(fields map[string]interface{}) []string {
+	names := make([]string, 0)
+	for fn, f := range fields {
+		switch fn {
+		case "$and", "$or":
+			for _, q := range subQueries(f) {
+				names = append(names, queryFieldNames(q)...)
+			}
+		case "$not":
+			names = append(names, queryFieldNames(queryFields(f))...)
+		default:
+			names = append(names, fn)
+		}
+	}
+	return names
+}
+
+// coveringIndex returns an ordered index holding every field the query
+// reads and returns, and the range of it to walk, so that the query can
+// be answered from its keys. The walk order is the sort order.
+func (db *Database) coveringIndex(fields map[string]interface{}, opts FindOptions) (*Index, keyRange, bool) {
+	if len(opts.Include) == 0 {
+		return nil, keyRange{}, false
+	}
+
+	needed := make([]string, 0)
+	needed = append(needed, opts.Include...)
+	needed = append(needed, queryFieldNames(fields)...)
+	for _, f := range opts.Sort {
+		needed = append(needed, f.Field)
+	}
+	covers := func(idx *Index) bool {
+		if idx.Multikey || !idx.usableFor(fields) {
+			return false
+		}
+		for _, f := range needed {
+			if f == idField || strings.HasPrefix(f, "$") {
+				continue
+			}
+			found := false
+			for _, fn := range idx.Fields {
+				if fn == f {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	}
+
+	if len(opts.Sort) > 0 {
+		if idx, r, ok := db.sortIndex(fields, opts.Sort); ok && covers(idx) {
+			return idx, r, true
+		}
+		return nil, keyRange{}, false
+	}
+
+	pf := planFields(fields)
+	names := make([]string, 0, len(db.Indexes))
+	for name := range db.Indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var best *Index
+	var bestRange keyRange
+	bestFields := -1
+	for _, name := range names {
+		idx := db.Indexes[name]
+		if !idx.Ordered || !covers(idx) {
+			continue
+		}
+		r, n, ok := idx.queryRange(pf)
+		if !ok {
+			r, n = keyRange{}, 0
+		}
+		if n > bestFields {
+			best, bestRange, bestFields = idx, r, n
+		}
+	}
+	return best, bestRange, best != nil
+}
+
+// covered answers a query from the keys of a covering index, reading a
+// document only if its key can't be decoded. The caller must hold a
+// lock.
+func (db *Database) covered(idx *Index, r keyRange, fields map[string]interface{}, opts FindOptions, p *Plan) (int, []*Document) {
+	log.Trace("Using covering index %s", idx.Name)
+	p.strategy("covered index", idx)
+	p.consider(idx)
+	if p != nil && len(opts.Sort) > 0 {
+		p.Sort = "index"
+	}
+
+	walk := idx.Tree.Walk
+	if len(opts.Sort) > 0 && opts.Sort[0].Desc {
+		walk = idx.Tree.WalkReverse
+	}
+
+	results := make([]*Document, 0)
+	mc := 0
+	walk(r, func(l *Leaf) bool {
+		p.leaf()
+		p.candidates(len(l.Documents))
+		keyValues, ok := idx.keyValues(l.Unsplit)
+		for _, d := range l.Documents {
+			p.examined()
+			values := keyValues
+			if !ok {
+				values = d.Values()
+			}
+			if matchFields(d, values, fields) {
+				if mc >= opts.Start && (opts.Limit <= 0 || len(results) < opts.Limit) {
+					results = append(results, project(d, values, opts))
+				}
+				mc++
+			}
+		}
+		return true
+	})
+	return mc, results
+}
@@ -0,0 +1,96 @@
+package godb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+type TestProjectedDoc struct {
+	Name  string
+	Age   int
+	Email string
+}
+
+func TestFindProjection(t *testing.T) {
+	db := NewDatabase()
+	for i := 0; i < 100; i++ {
+		db.Insert(&TestProjectedDoc{
+			Name:  "Test document " + strconv.Itoa(i),
+			Age:   i,
+			Email: "test" + strconv.Itoa(i) + "@example.com",
+		})
+	}
+
+	n, docs := db.FindWithOptions(Q{"Age": Gte(90)}, FindOptions{Include: []string{"Name"}})
+	assert.Equal(t, n, 10, "10 results")
+	for _, doc := range docs {
+		assert.Equal(t, len(doc.Fields), 1, "only included fields are returned")
+		var d TestProjectedDoc
+		doc.Unmarshal(&d)
+		assert.NotEqual(t, d.Name, "", "included field is set")
+		assert.Equal(t, d.Age, 0, "excluded field is left unset")
+	}
+
+	_, docs = db.FindWithOptions(nil, FindOptions{Exclude: []string{"Email"}, Limit: 5})
+	for _, doc := range docs {
+		_, ok := doc.Fields["Email"]
+		assert.False(t, ok, "excluded field isn't returned")
+		assert.Equal(t, len(doc.Fields), 2, "other fields are returned")
+	}
+	assert.Equal(t, len(db.Documents[0].Fields), 3, "stored documents aren't modified")
+}
+
+// countingStorage counts the document bodies read from it
+type countingStorage struct {
+	*MmapStorage
+	Gets int
+}
+
+func (s *countingStorage) Get(offset int64) (map[string]interface{}, error) {
+	s.Gets++
+	return s.MmapStorage.Get(offset)
+}
+
+func TestFindCoveredByIndex(t *testing.T) {
+	ms, err := NewMmapStorage(filepath.Join(t.TempDir(), "godb.data"))
+	assert.Nil(t, err, "no error opening storage")
+	defer ms.Close()
+	s := &countingStorage{MmapStorage: ms}
+
+	db, err := NewDatabaseWithStorage(s)
+	assert.Nil(t, err, "no error creating database")
+	db.NewIndexWithOptions([]string{"Name", "Age"}, Ordered())
+	for i := 0; i < 100; i++ {
+		db.Insert(&TestProjectedDoc{
+			Name:  "Test document " + strconv.Itoa(i%10),
+			Age:   i,
+			Email: "test" + strconv.Itoa(i) + "@example.com",
+		})
+	}
+
+	opts := FindOptions{Include: []string{"Name", "Age"}, Sort: []SortField{Desc("Age")}, Limit: 3}
+	idx, _, ok := db.coveringIndex(Q{"Name": "Test document 3"}, opts)
+	if assert.True(t, ok, "index covers the query") {
+		assert.Equal(t, idx.Name, "Name-Age")
+	}
+	s.Gets = 0
+	n, docs := db.FindWithOptions(Q{"Name": "Test document 3"}, opts)
+	assert.Equal(t, n, 10, "10 results")
+	assert.Equal(t, sortedAges(docs), []int{93, 83, 73}, "results come from the index in order")
+	for _, doc := range docs {
+		assert.Equal(t, doc.Fields["Name"], "Test document 3", "name is decoded from the key")
+	}
+	assert.Equal(t, s.Gets, 0, "documents aren't read from storage")
+
+	n, docs = db.FindWithOptions(Q{"Name": Prefix("Test document 3")}, FindOptions{Include: []string{"Age"}})
+	assert.Equal(t, n, 10, "10 results")
+	assert.Equal(t, len(docs[0].Fields), 1, "only included fields are returned")
+	assert.Equal(t, s.Gets, 0, "documents aren't read from storage")
+
+	_, _, ok = db.coveringIndex(Q{"Email": "x"}, FindOptions{Include: []string{"Name"}})
+	assert.False(t, ok, "index doesn't cover a query on another field")
+	_, _, ok = db.coveringIndex(Q{"Name": "x"}, FindOptions{Include: []string{"Email"}})
+	assert.False(t, ok, "index doesn't cover a projection of another field")
+}
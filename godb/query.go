@@ -0,0 +1,562 @@
+package godb
+
+import (
+	"bytes"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Q is a query document, e.g.
+//
+//	godb.Q{"Age": godb.Gt(30), "Name": godb.In("a", "b")}
+//
+// It can be passed to Find in place of a struct, and used as the value
+// of a query field in place of an exact value.
+type Q map[string]interface{}
+
+func Eq(v interface{}) Q {
+	return Q{"$eq": v}
+}
+
+func Ne(v interface{}) Q {
+	return Q{"$ne": v}
+}
+
+func Gt(v interface{}) Q {
+	return Q{"$gt": v}
+}
+
+func Gte(v interface{}) Q {
+	return Q{"$gte": v}
+}
+
+func Lt(v interface{}) Q {
+	return Q{"$lt": v}
+}
+
+func Lte(v interface{}) Q {
+	return Q{"$lte": v}
+}
+
+// In matches values equal to any of vs
+func In(vs ...interface{}) Q {
+	return Q{"$in": vs}
+}
+
+// Nin matches values equal to none of vs
+func Nin(vs ...interface{}) Q {
+	return Q{"$nin": vs}
+}
+
+// Exists matches documents which have (or don't have) the field
+func Exists(exists bool) Q {
+	return Q{"$exists": exists}
+}
+
+// Regex matches strings against pattern. Like regexp.MustCompile it
+// panics if the pattern is invalid.
+func Regex(pattern string) Q {
+	return Q{"$regex": regexp.MustCompile(pattern)}
+}
+
+// Prefix matches strings starting with prefix
+func Prefix(prefix string) Q {
+	return Q{"$prefix": prefix}
+}
+
+// And matches documents matching every query
+func And(queries ...Q) Q {
+	return Q{"$and": queries}
+}
+
+// Or matches documents matching any of the queries
+func Or(queries ...Q) Q {
+	return Q{"$or": queries}
+}
+
+// Not negates a query, or a field condition when used as a field value,
+// e.g. godb.Q{"Age": godb.Not(godb.Gt(30))}
+func Not(cond interface{}) Q {
+	return Q{"$not": cond}
+}
+
+// queryFields returns the fields of a query, which is either a Q or a
+// struct pointer. A nil query matches every document.
+func queryFields(query interface{}) map[string]interface{} {
+	switch q := query.(type) {
+	case nil:
+		return make(map[string]interface{})
+	case Q:
+		return q
+	case map[string]interface{}:
+		return q
+	}
+	return GetFields(query)
+}
+
+// subQueries returns the queries given to $and or $or
+func subQueries(arg interface{}) []map[string]interface{} {
+	queries := make([]map[string]interface{}, 0)
+	switch arg := arg.(type) {
+	case []Q:
+		for _, q := range arg {
+			queries = append(queries, q)
+		}
+	case []interface{}:
+		for _, q := range arg {
+			queries = append(queries, queryFields(q))
+		}
+	case []map[string]interface{}:
+		queries = append(queries, arg...)
+	default:
+		queries = append(queries, queryFields(arg))
+	}
+	return queries
+}
+
+// isOperator reports whether v is an operator document
+func isOperator(v interface{}) bool {
+	q, ok := v.(Q)
+	if !ok || len(q) == 0 {
+		return false
+	}
+	for k := range q {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// matchFields reports whether the document values match the query. Keys
+// starting with $ are logical operators, other keys are field names.
+func matchFields(d *Document, values map[string]interface{}, fields map[string]interface{}) bool {
+	for fn, f := range fields {
+		switch fn {
+		case "$and":
+			for _, q := range subQueries(f) {
+				if !matchFields(d, values, q) {
+					return false
+				}
+			}
+		case "$or":
+			matched := false
+			for _, q := range subQueries(f) {
+				if matchFields(d, values, q) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		case "$not":
+			if matchFields(d, values, queryFields(f)) {
+				return false
+			}
+		case idField:
+			if !matchValue(d.ObjectID, true, f) {
+				return false
+			}
+		default:
+			v, ok := lookupPath(values, fn)
+			if !matchValue(v, ok, f) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// lookupPath returns the value at a field path in a document's values.
+// A dotted path such as Address.City reads nested maps, a numeric part
+// such as Tags.0 indexes a slice, and any other part read through a
+// slice collects the value from each element.
+func lookupPath(values map[string]interface{}, path string) (interface{}, bool) {
+	if v, ok := values[path]; ok {
+		return v, true
+	}
+	i := strings.IndexByte(path, '.')
+	if i < 0 {
+		return nil, false
+	}
+	v, ok := values[path[:i]]
+	if !ok {
+		return nil, false
+	}
+	return lookupIn(v, path[i+1:])
+}
+
+func lookupIn(v interface{}, path string) (interface{}, bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return lookupPath(v, path)
+	case []interface{}:
+		head, rest := path, ""
+		if i := strings.IndexByte(path, '.'); i >= 0 {
+			head, rest = path[:i], path[i+1:]
+		}
+		if n, err := strconv.Atoi(head); err == nil {
+			if n < 0 || n >= len(v) {
+				return nil, false
+			}
+			if rest == "" {
+				return v[n], true
+			}
+			return lookupIn(v[n], rest)
+		}
+
+		found := make([]interface{}, 0)
+		for _, e := range v {
+			ev, ok := lookupIn(e, path)
+			if !ok {
+				continue
+			}
+			if list, ok := ev.([]interface{}); ok {
+				found = append(found, list...)
+			} else {
+				found = append(found, ev)
+			}
+		}
+		if len(found) == 0 {
+			return nil, false
+		}
+		return found, true
+	}
+	return nil, false
+}
+
+// anyElement reports whether fn is true for v or, if v is a slice, any
+// of its elements
+func anyElement(v interface{}, fn func(interface{}) bool) bool {
+	if fn(v) {
+		return true
+	}
+	if list, ok := v.([]interface{}); ok {
+		for _, e := range list {
+			if fn(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isList reports whether v is a slice value other than bytes, which a
+// multikey index holds by element
+func isList(v interface{}) bool {
+	rv := reflect.ValueOf(v)
+	return (rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array) && !isBytes(rv)
+}
+
+// matchValue reports whether a document value matches a query value,
+// which is either an exact value or an operator document. exists is
+// false if the document doesn't have the field. A slice value matches
+// if it or any of its elements does.
+func matchValue(v interface{}, exists bool, cond interface{}) bool {
+	if !isOperator(cond) {
+		if cond == nil {
+			return !exists || v == nil
+		}
+		return exists && anyElement(v, func(e interface{}) bool {
+			return equalValues(e, cond)
+		})
+	}
+
+	for op, arg := range cond.(Q) {
+		var ok bool
+		switch op {
+		case "$eq":
+			ok = matchValue(v, exists, arg)
+		case "$ne":
+			ok = !matchValue(v, exists, arg)
+		case "$gt", "$gte", "$lt", "$lte":
+			ok = exists && anyElement(v, func(e interface{}) bool {
+				c, comparable := compareValues(e, arg)
+				switch op {
+				case "$gt":
+					return comparable && c > 0
+				case "$gte":
+					return comparable && c >= 0
+				case "$lt":
+					return comparable && c < 0
+				}
+				return comparable && c <= 0
+			})
+		case "$in":
+			ok = inValues(v, exists, arg)
+		case "$nin":
+			ok = !inValues(v, exists, arg)
+		case "$exists":
+			want, _ := arg.(bool)
+			ok = exists == want
+		case "$regex":
+			ok = anyElement(v, func(e interface{}) bool {
+				s, isString := e.(string)
+				switch re := arg.(type) {
+				case *regexp.Regexp:
+					return isString && re.MatchString(s)
+				case string:
+					matched, err := regexp.MatchString(re, s)
+					return isString && err == nil && matched
+				}
+				return false
+			})
+		case "$prefix":
+			p, _ := arg.(string)
+			ok = anyElement(v, func(e interface{}) bool {
+				s, isString := e.(string)
+				return isString && strings.HasPrefix(s, p)
+			})
+		case "$not":
+			ok = !matchValue(v, exists, arg)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func inValues(v interface{}, exists bool, arg interface{}) bool {
+	for _, a := range valueList(arg) {
+		if matchValue(v, exists, a) {
+			return true
+		}
+	}
+	return false
+}
+
+// valueList returns the values of a slice given to $in or $nin
+func valueList(arg interface{}) []interface{} {
+	if vs, ok := arg.([]interface{}); ok {
+		return vs
+	}
+	rv := reflect.ValueOf(arg)
+	if (rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array) || isBytes(rv) {
+		return []interface{}{arg}
+	}
+	vs := make([]interface{}, rv.Len())
+	for i := range vs {
+		vs[i] = rv.Index(i).Interface()
+	}
+	return vs
+}
+
+// equalValues compares values without panicking on uncomparable types.
+// Numbers compare by value whatever their type, including within slices
+// and maps.
+func equalValues(a, b interface{}) bool {
+	if c, ok := compareValues(a, b); ok {
+		return c == 0
+	}
+
+	ra, rb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if isList(a) && isList(b) {
+		if ra.Len() != rb.Len() {
+			return false
+		}
+		for i := 0; i < ra.Len(); i++ {
+			if !equalValues(ra.Index(i).Interface(), rb.Index(i).Interface()) {
+				return false
+			}
+		}
+		return true
+	}
+	if isStringMap(ra) && isStringMap(rb) {
+		if ra.Len() != rb.Len() {
+			return false
+		}
+		for _, k := range ra.MapKeys() {
+			bv := rb.MapIndex(k.Convert(rb.Type().Key()))
+			if !bv.IsValid() || !equalValues(ra.MapIndex(k).Interface(), bv.Interface()) {
+				return false
+			}
+		}
+		return true
+	}
+
+	ta, tb := reflect.TypeOf(a), reflect.TypeOf(b)
+	if ta != tb {
+		return false
+	}
+	if ta != nil && ta.Comparable() {
+		return a == b
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func isNumber(v interface{}) bool {
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func toFloat(v interface{}) float64 {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(rv.Uint())
+	}
+	return rv.Float()
+}
+
+// compareValues orders two values of the same type family. Numbers of
+// any type compare by value, and named basic types as their kind. The
+// second result is false if the values can't be ordered against each
+// other.
+func compareValues(a, b interface{}) (int, bool) {
+	if bv, ok := basicValue(reflect.ValueOf(a)); ok {
+		a = bv
+	}
+	if bv, ok := basicValue(reflect.ValueOf(b)); ok {
+		b = bv
+	}
+	if isNumber(a) && isNumber(b) {
+		ra, rb := reflect.ValueOf(a), reflect.ValueOf(b)
+		if isInt(ra) && isInt(rb) {
+			x, y := ra.Int(), rb.Int()
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+		if isUint(ra) && isUint(rb) {
+			x, y := ra.Uint(), rb.Uint()
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+		x, y := toFloat(a), toFloat(b)
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		case x == y:
+			return 0, true
+		}
+		return 0, false
+	}
+
+	// []byte and named byte slices such as ObjectID
+	ra, rb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if isBytes(ra) && isBytes(rb) {
+		return bytes.Compare(ra.Bytes(), rb.Bytes()), true
+	}
+
+	switch a := a.(type) {
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), true
+		}
+	case bool:
+		if b, ok := b.(bool); ok {
+			switch {
+			case a == b:
+				return 0, true
+			case b:
+				return -1, true
+			}
+			return 1, true
+		}
+	case time.Time:
+		if b, ok := b.(time.Time); ok {
+			switch {
+			case a.Before(b):
+				return -1, true
+			case a.After(b):
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+
+	return 0, false
+}
+
+func isInt(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+func isStringMap(v reflect.Value) bool {
+	return v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String
+}
+
+func isBytes(v reflect.Value) bool {
+	return v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8
+}
+
+func isUint(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return false
+}
+
+// fieldRange returns the key range an ordered index can scan for a
+// query value, after the encoded values of any leading equality fields
+// in prefix. The second result is false if the value can't be turned
+// into a range.
+func fieldRange(prefix []byte, cond interface{}) (keyRange, bool) {
+	if !isOperator(cond) {
+		k := appendKey(append([]byte{}, prefix...), cond)
+		return keyRange{Lo: k, Hi: k}, true
+	}
+
+	r := keyRange{}
+	var tag byte
+	for op, arg := range cond.(Q) {
+		switch op {
+		case "$gt", "$gte":
+			r.Lo = appendKey(append([]byte{}, prefix...), arg)
+			tag = keyTag(arg)
+		case "$lt", "$lte":
+			r.Hi = appendKey(append([]byte{}, prefix...), arg)
+			tag = keyTag(arg)
+		case "$prefix":
+			p, ok := arg.(string)
+			if !ok {
+				return r, false
+			}
+			r.Lo = appendEscapedPrefix(append(append([]byte{}, prefix...), keyString), []byte(p))
+			r.Hi = r.Lo
+			tag = keyString
+		}
+		// other operators only narrow the range and are left to the
+		// filter
+	}
+	if tag == 0 {
+		return r, false
+	}
+
+	// keep the scan within values of the same type
+	if r.Lo == nil {
+		r.Lo = append(append([]byte{}, prefix...), tag)
+	}
+	if r.Hi == nil {
+		r.Hi = append(append([]byte{}, prefix...), tag)
+	}
+	return r, true
+}
@@ -0,0 +1,214 @@
+package godb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func queryTestDatabases() (Database, Database) {
+	scan := NewDatabase()
+	indexed := NewDatabase()
+	indexed.NewIndex("Name")
+	indexed.NewIndexWithOptions([]string{"Age"}, Ordered())
+
+	for i := 0; i < 1000; i++ {
+		doc := &TestDoc{
+			Name: "Test document " + strconv.Itoa(i%100),
+			Age:  i % 60,
+		}
+		scan.Insert(doc)
+		indexed.Insert(doc)
+	}
+	return scan, indexed
+}
+
+func TestQueryOperators(t *testing.T) {
+	scan, indexed := queryTestDatabases()
+
+	tests := []struct {
+		query Q
+		count int
+	}{
+		{Q{"Age": 5}, 17},
+		{Q{"Age": Eq(5)}, 17},
+		{Q{"Age": Ne(5)}, 983},
+		{Q{"Age": Gt(50)}, 144},
+		{Q{"Age": Gte(50)}, 160},
+		{Q{"Age": Lt(10)}, 170},
+		{Q{"Age": Lte(10)}, 187},
+		{Q{"Age": Q{"$gte": 10, "$lt": 20}}, 170},
+		{Q{"Age": int64(5)}, 17},
+		{Q{"Age": In(1, 2, 3)}, 51},
+		{Q{"Age": Nin(1, 2, 3)}, 949},
+		{Q{"Name": In("Test document 1", "Test document 2")}, 20},
+		{Q{"Name": Nin("Test document 1", "Test document 2")}, 980},
+		{Q{"Name": Exists(true)}, 1000},
+		{Q{"Email": Exists(false)}, 1000},
+		{Q{"Email": Exists(true)}, 0},
+		{Q{"Name": Regex("^Test document 9\\d$")}, 100},
+		{Q{"Name": Regex("document 1$")}, 10},
+		{Q{"Name": Prefix("Test document 9")}, 110},
+		{Q{"Age": Not(Gt(50))}, 856},
+		{Not(Q{"Age": Gt(50)}), 856},
+		{Q{"Name": "Test document 5", "Age": Gt(30)}, 3},
+		{And(Q{"Age": Gte(10)}, Q{"Age": Lt(20)}), 170},
+		{Or(Q{"Age": 5}, Q{"Name": "Test document 1"}), 27},
+		{Or(Q{"Age": 5}, Q{"Age": Gt(50)}), 161},
+		{Q{"Name": "Test document 5", "$or": []Q{{"Age": 5}, {"Age": 45}}}, 7},
+		{And(Q{"Name": Prefix("Test document 1")}, Q{"$or": []Q{{"Age": Lt(5)}, {"Age": Gt(55)}}}), 16},
+	}
+
+	for _, test := range tests {
+		n, docs := scan.Find(test.query, 0, 0)
+		assert.Equal(t, n, test.count, "scan count for %v", test.query)
+		for _, d := range docs {
+			assert.True(t, matchDocument(d, test.query), "scan result matches %v", test.query)
+		}
+
+		n, docs = indexed.Find(test.query, 0, 0)
+		assert.Equal(t, n, test.count, "indexed count for %v", test.query)
+		for _, d := range docs {
+			assert.True(t, matchDocument(d, test.query), "indexed result matches %v", test.query)
+		}
+	}
+}
+
+func TestQueryPlannerUsesIndexes(t *testing.T) {
+	_, db := queryTestDatabases()
+
+	docs, exact := db.candidates(Q{"Name": In("Test document 1", "Test document 2")})
+	assert.Equal(t, exact, false, "$in candidates are filtered")
+	assert.Equal(t, len(docs), 20, "$in uses index lookups")
+
+	docs, _ = db.candidates(Q{"Age": Eq(5)})
+	assert.Equal(t, len(docs), 17, "$eq uses the ordered index")
+
+	docs, _ = db.candidates(Q{"Age": Q{"$gte": 50, "$ne": 55}})
+	assert.Equal(t, len(docs), 160, "range is narrowed by other operators in the filter")
+
+	docs, _ = db.candidates(And(Q{"Name": "Test document 1"}, Q{"Age": Ne(1)}))
+	assert.Equal(t, len(docs), 10, "$and conditions are used by the planner")
+
+	docs, _ = db.candidates(Or(Q{"Age": 5}, Q{"Name": "Test document 1"}))
+	assert.Equal(t, len(docs), 27, "indexed $or branches are unioned")
+
+	docs, _ = db.candidates(Or(Q{"Age": 5}, Q{"Email": "x"}))
+	assert.Equal(t, len(docs), 1000, "$or with an unindexed branch scans")
+
+	docs, _ = db.candidates(Q{"Age": Ne(5)})
+	assert.Equal(t, len(docs), 1000, "$ne scans")
+}
+
+type TestAddress struct {
+	Street string
+	City   string
+}
+
+type TestBase struct {
+	Created int
+}
+
+type TestPerson struct {
+	TestBase
+	Name      string
+	Address   TestAddress
+	Previous  []TestAddress
+	Tags      []string
+	Scores    map[string]int
+	Nickname  *string
+	Secondary *TestAddress
+}
+
+func TestNestedDocuments(t *testing.T) {
+	db := NewDatabase()
+	nick := "Bob"
+	_, docs, _ := db.Insert(
+		&TestPerson{
+			TestBase: TestBase{Created: 1},
+			Name:     "Robert",
+			Address:  TestAddress{Street: "High Street", City: "London"},
+			Previous: []TestAddress{{City: "Leeds"}, {City: "York"}},
+			Tags:     []string{"admin", "staff"},
+			Scores:   map[string]int{"go": 3},
+			Nickname: &nick,
+		},
+		&TestPerson{
+			Name:    "Alice",
+			Address: TestAddress{City: "Paris"},
+			Tags:    []string{"staff"},
+		},
+	)
+
+	assert.Equal(t, docs[0].Fields["Created"], 1, "embedded fields are promoted")
+	assert.Equal(t, docs[0].Fields["Address"], map[string]interface{}{"Street": "High Street", "City": "London"})
+	assert.Equal(t, docs[0].Fields["Tags"], []interface{}{"admin", "staff"})
+	assert.Equal(t, docs[0].Fields["Nickname"], "Bob", "pointers are stored as their value")
+
+	tests := []struct {
+		query Q
+		count int
+	}{
+		{Q{"Address.City": "London"}, 1},
+		{Q{"Address.City": In("London", "Paris")}, 2},
+		{Q{"Previous.City": "York"}, 1},
+		{Q{"Previous.1.City": "York"}, 1},
+		{Q{"Previous.0.City": "York"}, 0},
+		{Q{"Scores.go": Gt(2)}, 1},
+		{Q{"Tags": "staff"}, 2},
+		{Q{"Tags": Ne("admin")}, 1},
+		{Q{"Tags": Nin("admin", "other")}, 1},
+		{Q{"Tags": Prefix("adm")}, 1},
+		{Q{"Tags": []string{"admin", "staff"}}, 1},
+		{Q{"Tags.0": "staff"}, 1},
+		{Q{"Address": Q{"$eq": map[string]interface{}{"City": "Paris"}}}, 0},
+		{Q{"Address": map[string]interface{}{"Street": "", "City": "Paris"}}, 1},
+	}
+	for _, test := range tests {
+		n, _ := db.Find(test.query, 0, 0)
+		assert.Equal(t, n, test.count, "count for query %v", test.query)
+	}
+
+	var p TestPerson
+	docs[0].Unmarshal(&p)
+	assert.Equal(t, p.Created, 1)
+	assert.Equal(t, p.Address, TestAddress{Street: "High Street", City: "London"})
+	assert.Equal(t, p.Previous, []TestAddress{{City: "Leeds"}, {City: "York"}})
+	assert.Equal(t, p.Tags, []string{"admin", "staff"})
+	assert.Equal(t, p.Scores, map[string]int{"go": 3})
+	if assert.NotNil(t, p.Nickname) {
+		assert.Equal(t, *p.Nickname, "Bob")
+	}
+	assert.Nil(t, p.Secondary, "nil pointers stay nil")
+}
+
+func TestQueryNamedKinds(t *testing.T) {
+	for _, opts := range [][]IndexOption{nil, {}, {Ordered()}} {
+		db := NewDatabase()
+		if opts != nil {
+			db.NewIndexWithOptions([]string{"Status"}, opts...)
+		}
+		db.Insert(
+			&TestNamedKinds{Status: "active", Timeout: time.Second},
+			&TestNamedKinds{Status: "closed", Timeout: time.Minute},
+		)
+		assert.Equal(t, db.Documents[0].Fields["Status"], "active", "named string is stored as a string")
+
+		for _, q := range []Q{
+			{"Status": "active"},
+			{"Status": TestStatus("active")},
+			{"Status": In("active", "other")},
+			{"Status": Lt(TestStatus("b"))},
+			{"Timeout": time.Second},
+			{"Timeout": Lt(2 * time.Second)},
+		} {
+			n, docs := db.Find(q, 0, 0)
+			if assert.Equal(t, n, 1, "%v matches a named kind", q) {
+				var d TestNamedKinds
+				docs[0].Unmarshal(&d)
+				assert.Equal(t, d.Status, TestStatus("active"))
+			}
+		}
+	}
+}
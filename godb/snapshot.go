@@ -0,0 +1,284 @@
+package godb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+var ErrNotSnapshot = errors.New("Not a snapshot file")
+var ErrNoWAL = errors.New("Database has no write-ahead log")
+
+var snapshotMagic = []byte("GODBSNAP")
+
+// snapshotVersion 2 added index options
+const snapshotVersion = 2
+
+// Snapshot writes every document and index definition to w. Writes are
+// blocked until the snapshot is complete.
+func (db *Database) Snapshot(w io.Writer) error {
+	db.DBLock.Lock()
+	defer db.DBLock.Unlock()
+	db.WriteLock.Lock()
+	defer db.WriteLock.Unlock()
+
+	var generation uint64
+	if db.WAL != nil {
+		generation = db.WAL.Generation
+	}
+	return db.snapshot(w, generation)
+}
+
+// Checkpoint writes a snapshot alongside the write-ahead log and then
+// truncates the log, so the next Open only replays mutations made after
+// the checkpoint.
+func (db *Database) Checkpoint() error {
+	if db.WAL == nil {
+		return ErrNoWAL
+	}
+
+	db.DBLock.Lock()
+	defer db.DBLock.Unlock()
+	db.WriteLock.Lock()
+	defer db.WriteLock.Unlock()
+
+	generation := db.WAL.Generation + 1
+	path := snapshotPath(db.WAL.Path)
+	tmp := path + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := db.snapshot(f, generation); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return db.WAL.Reset(generation)
+}
+
+func snapshotPath(walPath string) string {
+	return walPath + ".snapshot"
+}
+
+// snapshot writes the database to w. The caller must hold both locks.
+//
+// The format is the magic bytes, a version, the log generation, the
+// length-prefixed index definitions, a document count, then each
+// document prefixed with its encoded length. A CRC-32 of everything
+// before it ends the file.
+func (db *Database) snapshot(w io.Writer, generation uint64) error {
+	crc := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+
+	b := append([]byte{}, snapshotMagic...)
+	b = append(b, snapshotVersion)
+	b = appendUvarint(b, generation)
+
+	names := make([]string, 0, len(db.Indexes))
+	for name := range db.Indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	defs := appendUvarint(nil, uint64(len(names)))
+	for _, name := range names {
+		def, err := appendIndexDef(defs, db.Indexes[name])
+		if err != nil {
+			return err
+		}
+		defs = def
+	}
+	b = appendBytes(b, defs)
+	b = appendUvarint(b, uint64(len(db.Documents)))
+	if _, err := bw.Write(b); err != nil {
+		return err
+	}
+
+	var buf []byte
+	for _, doc := range db.Documents {
+		rec, err := appendDocument(buf[:0], doc)
+		if err != nil {
+			return err
+		}
+		buf = rec
+		if _, err := bw.Write(appendUvarint(nil, uint64(len(rec)))); err != nil {
+			return err
+		}
+		if _, err := bw.Write(rec); err != nil {
+			return err
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], crc.Sum32())
+	_, err := w.Write(sum[:])
+	return err
+}
+
+// LoadSnapshot reads a database written by Snapshot. Indexes are built
+// once all documents are loaded rather than per document.
+func LoadSnapshot(r io.Reader) (*Database, error) {
+	db, _, err := loadSnapshot(r)
+	return db, err
+}
+
+// openSnapshot loads the snapshot file at path, or returns an empty
+// database if there isn't one.
+func openSnapshot(path string) (*Database, uint64, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		db := NewDatabase()
+		return &db, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	return loadSnapshot(f)
+}
+
+func loadSnapshot(r io.Reader) (*Database, uint64, error) {
+	crc := crc32.NewIEEE()
+	br := &snapshotReader{r: bufio.NewReader(r), crc: crc}
+
+	hdr := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, 0, err
+	}
+	version := hdr[len(snapshotMagic)]
+	if !bytes.Equal(hdr[:len(snapshotMagic)], snapshotMagic) || version < 1 || version > snapshotVersion {
+		return nil, 0, ErrNotSnapshot
+	}
+
+	generation, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defs, err := br.readBytes()
+	if err != nil {
+		return nil, 0, err
+	}
+	d := &decoder{buf: defs}
+	n, err := d.uvarint()
+	if err != nil {
+		return nil, 0, err
+	}
+	type indexDef struct {
+		fields []string
+		opts   []IndexOption
+	}
+	defList := make([]indexDef, 0)
+	for i := uint64(0); i < n; i++ {
+		fields, opts, err := d.indexDef(version >= 2)
+		if err != nil {
+			return nil, 0, err
+		}
+		defList = append(defList, indexDef{fields, opts})
+	}
+
+	n, err = binary.ReadUvarint(br)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	db := NewDatabase()
+	for i := uint64(0); i < n; i++ {
+		rec, err := br.readBytes()
+		if err != nil {
+			return nil, 0, err
+		}
+		d := &decoder{buf: rec}
+		doc, err := d.document()
+		if err != nil {
+			return nil, 0, err
+		}
+		db.Documents = append(db.Documents, doc)
+		db.IDs[string(doc.ObjectID)] = doc
+	}
+
+	sum := crc.Sum32()
+	var tail [4]byte
+	if _, err := io.ReadFull(br.r, tail[:]); err != nil {
+		return nil, 0, err
+	}
+	if binary.LittleEndian.Uint32(tail[:]) != sum {
+		return nil, 0, ErrCorrupt
+	}
+
+	if len(defList) > 0 {
+		idxs := make([]*Index, len(defList))
+		for i, def := range defList {
+			idxs[i] = newIndex(&db, def.fields, def.opts...)
+		}
+		if err := db.addIndexes(idxs...); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return &db, generation, nil
+}
+
+// snapshotReader checksums everything read through it
+type snapshotReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+}
+
+func (sr *snapshotReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	sr.crc.Write(p[:n])
+	return n, err
+}
+
+func (sr *snapshotReader) ReadByte() (byte, error) {
+	c, err := sr.r.ReadByte()
+	if err == nil {
+		sr.crc.Write([]byte{c})
+	}
+	return c, err
+}
+
+func (sr *snapshotReader) readBytes() ([]byte, error) {
+	l, err := binary.ReadUvarint(sr)
+	if err != nil {
+		return nil, err
+	}
+	if l > 1<<32 {
+		return nil, ErrCorrupt
+	}
+	b := make([]byte, l)
+	_, err = io.ReadFull(sr, b)
+	return b, err
+}
@@ -0,0 +1,120 @@
+package godb
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	db := NewDatabase()
+	db.NewIndex("Name")
+	db.NewIndex("Name", "Age")
+	db.NewIndexWithOptions([]string{"Age"}, Ordered())
+
+	for i := 0; i < 1000; i++ {
+		db.Insert(&TestDoc{
+			Name: "Test document " + strconv.Itoa(i),
+			Age:  i % 50,
+		})
+	}
+
+	var buf bytes.Buffer
+	err := db.Snapshot(&buf)
+	assert.Nil(t, err, "no error writing snapshot")
+
+	db2, err := LoadSnapshot(bytes.NewReader(buf.Bytes()))
+	assert.Nil(t, err, "no error loading snapshot")
+	assert.Equal(t, len(db2.Documents), 1000, "db contains 1000 documents")
+	assert.Equal(t, len(db2.Indexes), 3, "indexes are restored")
+	assert.Equal(t, db2.GetIndex("Age").Ordered, true, "index options are restored")
+	assert.Equal(t, db2.GetIndex("Name", "Age").Count, 1000, "index contains 1000 documents")
+
+	for i, doc := range db.Documents {
+		assert.Equal(t, db2.Documents[i].ObjectID, doc.ObjectID)
+		assert.Equal(t, db2.Documents[i].Fields, doc.Fields)
+	}
+
+	doc := db2.FindOne(&struct{ Name string }{Name: "Test document 123"}, 0)
+	if assert.NotNil(t, doc, "result for valid name") {
+		var d TestDoc
+		doc.Unmarshal(&d)
+		assert.Equal(t, d.Age, 23)
+	}
+}
+
+func TestLoadSnapshotCorrupt(t *testing.T) {
+	db := NewDatabase()
+	db.Insert(&TestDoc{Name: "Test document 1", Age: 1})
+
+	var buf bytes.Buffer
+	db.Snapshot(&buf)
+
+	b := buf.Bytes()
+	b[len(b)-6] ^= 0xff
+	_, err := LoadSnapshot(bytes.NewReader(b))
+	assert.NotNil(t, err, "error loading corrupt snapshot")
+
+	_, err = LoadSnapshot(bytes.NewReader([]byte("not a snapshot")))
+	assert.Equal(t, err, ErrNotSnapshot)
+}
+
+func TestCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godb.wal")
+
+	db, err := Open(path)
+	assert.Nil(t, err, "no error opening database")
+	db.NewIndex("Name")
+	for i := 0; i < 100; i++ {
+		db.Insert(&TestDoc{Name: "Test document " + strconv.Itoa(i), Age: i})
+	}
+
+	err = db.Checkpoint()
+	assert.Nil(t, err, "no error writing checkpoint")
+
+	for i := 100; i < 110; i++ {
+		db.Insert(&TestDoc{Name: "Test document " + strconv.Itoa(i), Age: i})
+	}
+	db.Close()
+
+	db, err = Open(path)
+	assert.Nil(t, err, "no error reopening database")
+	assert.Equal(t, len(db.Documents), 110, "db contains 110 documents")
+	assert.Equal(t, db.GetIndex("Name").Count, 110, "index contains 110 documents")
+	db.Close()
+}
+
+func TestCheckpointSkipsStaleLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godb.wal")
+
+	db, err := Open(path)
+	assert.Nil(t, err, "no error opening database")
+	for i := 0; i < 100; i++ {
+		db.Insert(&TestDoc{Name: "Test document " + strconv.Itoa(i), Age: i})
+	}
+	stale, err := os.ReadFile(path)
+	assert.Nil(t, err)
+
+	err = db.Checkpoint()
+	assert.Nil(t, err, "no error writing checkpoint")
+	db.Close()
+
+	// Simulate stopping after the snapshot was written but before the
+	// log was reset
+	err = os.WriteFile(path, stale, 0644)
+	assert.Nil(t, err)
+
+	db, err = Open(path)
+	assert.Nil(t, err, "no error reopening database")
+	assert.Equal(t, len(db.Documents), 100, "stale log is not replayed")
+	db.Insert(&TestDoc{Name: "Test document 100", Age: 100})
+	db.Close()
+
+	db, err = Open(path)
+	assert.Nil(t, err, "no error reopening database")
+	assert.Equal(t, len(db.Documents), 101, "log is usable after reset")
+	db.Close()
+}
@@ -0,0 +1,234 @@
+package godb
+
+import (
+	"container/heap"
+	"github.com/ian-kent/go-log/log"
+	"sort"
+)
+
+// SortField orders results by a field, e.g. godb.Desc("Age")
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+func Asc(field string) SortField {
+	return SortField{Field: field}
+}
+
+func Desc(field string) SortField {
+	return SortField{Field: field, Desc: true}
+}
+
+// sortDoc is a document with its sort key extracted, and its position
+// in the candidate order so that ties keep that order
+type sortDoc struct {
+	doc *Document
+	key []interface{}
+	seq int
+}
+
+func sortKey(d *Document, values map[string]interface{}, fields []SortField) []interface{} {
+	key := make([]interface{}, len(fields))
+	for i, f := range fields {
+		if f.Field == idField {
+			key[i] = d.ObjectID
+			continue
+		}
+		key[i], _ = lookupPath(values, f.Field)
+	}
+	return key
+}
+
+// orderValues orders any two values. Values of different types are
+// ordered the same way as in an ordered index, with nil first.
+func orderValues(a, b interface{}) int {
+	if c, ok := compareValues(a, b); ok {
+		return c
+	}
+	ta, tb := keyTag(a), keyTag(b)
+	switch {
+	case ta < tb:
+		return -1
+	case ta > tb:
+		return 1
+	}
+	return 0
+}
+
+// less reports whether a sorts before b
+func less(a, b *sortDoc, fields []SortField) bool {
+	for i, f := range fields {
+		c := orderValues(a.key[i], b.key[i])
+		if f.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
+	}
+	return a.seq < b.seq
+}
+
+// topK keeps the k first documents in sort order. The root of the heap
+// is the last of them, which is replaced when a document sorting
+// before it is pushed.
+type topK struct {
+	docs   []*sortDoc
+	fields []SortField
+}
+
+func (h *topK) Len() int           { return len(h.docs) }
+func (h *topK) Less(i, j int) bool { return less(h.docs[j], h.docs[i], h.fields) }
+func (h *topK) Swap(i, j int)      { h.docs[i], h.docs[j] = h.docs[j], h.docs[i] }
+
+func (h *topK) Push(x interface{}) {
+	h.docs = append(h.docs, x.(*sortDoc))
+}
+
+func (h *topK) Pop() interface{} {
+	d := h.docs[len(h.docs)-1]
+	h.docs = h.docs[:len(h.docs)-1]
+	return d
+}
+
+// sorted returns the number of documents matching the query and the
+// page of them in sort order. The caller must hold a lock.
+func (db *Database) sorted(fields map[string]interface{}, opts FindOptions, p *Plan) (int, []*Document) {
+	if idx, r, ok := db.sortIndex(fields, opts.Sort); ok {
+		log.Trace("Walking ordered index %s for sort", idx.Name)
+		p.strategy("sorted index", idx)
+		p.consider(idx)
+		if p != nil {
+			p.Sort = "index"
+		}
+		results := make([]*Document, 0)
+		mc := 0
+		walk := idx.Tree.Walk
+		if opts.Sort[0].Desc {
+			walk = idx.Tree.WalkReverse
+		}
+		walk(r, func(l *Leaf) bool {
+			p.leaf()
+			p.candidates(len(l.Documents))
+			for _, d := range l.Documents {
+				p.examined()
+				if matchDocument(d, fields) {
+					if mc >= opts.Start && (opts.Limit <= 0 || len(results) < opts.Limit) {
+						results = append(results, d)
+					}
+					mc++
+				}
+			}
+			return true
+		})
+		return mc, results
+	}
+
+	docs, exact := db.plannedCandidates(fields, p)
+	if p != nil {
+		p.Sort = "memory"
+	}
+
+	// with a limit only the first start+limit documents are kept
+	k := 0
+	if opts.Limit > 0 {
+		k = opts.Start + opts.Limit
+	}
+	h := &topK{docs: make([]*sortDoc, 0), fields: opts.Sort}
+
+	mc := 0
+	for _, d := range docs {
+		values := d.Values()
+		if !exact {
+			p.examined()
+			if !matchFields(d, values, fields) {
+				continue
+			}
+		}
+		sd := &sortDoc{doc: d, key: sortKey(d, values, opts.Sort), seq: mc}
+		mc++
+
+		switch {
+		case k == 0:
+			h.docs = append(h.docs, sd)
+		case len(h.docs) < k:
+			heap.Push(h, sd)
+		case less(sd, h.docs[0], opts.Sort):
+			h.docs[0] = sd
+			heap.Fix(h, 0)
+		}
+	}
+
+	sort.Slice(h.docs, func(i, j int) bool {
+		return less(h.docs[i], h.docs[j], opts.Sort)
+	})
+	results := make([]*Document, len(h.docs))
+	for i, sd := range h.docs {
+		results[i] = sd.doc
+	}
+	return mc, page(results, opts.Start, opts.Limit)
+}
+
+// sortIndex returns an ordered index whose key order is the sort order
+// for the query, and the range of it to walk. The sort fields must
+// follow any leading index fields the query fixes to one value, and
+// all sort in the same direction.
+func (db *Database) sortIndex(fields map[string]interface{}, sortFields []SortField) (*Index, keyRange, bool) {
+	for _, f := range sortFields {
+		if f.Desc != sortFields[0].Desc {
+			return nil, keyRange{}, false
+		}
+	}
+
+	pf := planFields(fields)
+	names := make([]string, 0, len(db.Indexes))
+	for name := range db.Indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// prefer the index which skips the most fields, and so has the
+	// narrowest range
+	var best *Index
+	bestSkipped := -1
+	for _, name := range names {
+		idx := db.Indexes[name]
+		if !idx.Ordered || idx.Multikey || !idx.usableFor(fields) {
+			continue
+		}
+
+		// skip fields with a single value
+		k := 0
+		for k < len(idx.Fields) && idx.Fields[k] != sortFields[0].Field {
+			v, ok := pf[idx.Fields[k]]
+			if !ok || isOperator(v) || isList(v) {
+				break
+			}
+			k++
+		}
+		if len(idx.Fields)-k < len(sortFields) {
+			continue
+		}
+		match := true
+		for i, f := range sortFields {
+			if idx.Fields[k+i] != f.Field {
+				match = false
+				break
+			}
+		}
+		if !match || k <= bestSkipped {
+			continue
+		}
+		best, bestSkipped = idx, k
+	}
+	if best == nil {
+		return nil, keyRange{}, false
+	}
+
+	r, _, ok := best.queryRange(pf)
+	if !ok {
+		r = keyRange{}
+	}
+	return best, r, true
+}
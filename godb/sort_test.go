@@ -0,0 +1,122 @@
+package godb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func sortedAges(docs []*Document) []int {
+	ages := make([]int, len(docs))
+	for i, doc := range docs {
+		var d TestDoc
+		doc.Unmarshal(&d)
+		ages[i] = d.Age
+	}
+	return ages
+}
+
+func TestFindSorted(t *testing.T) {
+	db := NewDatabase()
+	for i := 0; i < 1000; i++ {
+		db.Insert(&TestDoc{
+			Name: "Test document " + strconv.Itoa(i),
+			Age:  rand.Intn(100),
+		})
+	}
+
+	n, all := db.FindWithOptions(Q{"Age": Gte(50)}, FindOptions{Sort: []SortField{Asc("Age")}})
+	assert.Equal(t, len(all), n, "all results are returned without a limit")
+	ages := sortedAges(all)
+	for i := 1; i < len(ages); i++ {
+		assert.True(t, ages[i-1] <= ages[i], "results are in ascending order")
+	}
+
+	n2, top := db.FindWithOptions(Q{"Age": Gte(50)}, FindOptions{Sort: []SortField{Asc("Age")}, Limit: 10})
+	assert.Equal(t, n2, n, "count is independent of limit")
+	assert.Equal(t, top, all[:10], "top 10 are the first 10 of the full sort")
+
+	_, top = db.FindWithOptions(Q{"Age": Gte(50)}, FindOptions{Sort: []SortField{Asc("Age")}, Start: 20, Limit: 10})
+	assert.Equal(t, top, all[20:30], "paging applies after sorting")
+
+	_, desc := db.FindWithOptions(nil, FindOptions{Sort: []SortField{Desc("Age"), Asc("Name")}, Limit: 50})
+	assert.Equal(t, len(desc), 50, "limit is respected")
+	for i := 1; i < len(desc); i++ {
+		var a, b TestDoc
+		desc[i-1].Unmarshal(&a)
+		desc[i].Unmarshal(&b)
+		assert.True(t, a.Age > b.Age || (a.Age == b.Age && a.Name <= b.Name), "results are sorted by age then name")
+	}
+
+	_, newest := db.FindWithOptions(nil, FindOptions{Sort: []SortField{Desc("_id")}, Limit: 1})
+	assert.Equal(t, newest[0], db.Documents[len(db.Documents)-1], "newest document sorts first by _id")
+}
+
+func TestFindSortedByIndex(t *testing.T) {
+	db := NewDatabase()
+	unindexed := NewDatabase()
+	db.NewIndexWithOptions([]string{"Age"}, Ordered())
+	db.NewIndexWithOptions([]string{"Name", "Age"}, Ordered())
+
+	for i := 0; i < 1000; i++ {
+		doc := &TestDoc{
+			Name: "Test document " + strconv.Itoa(i%10),
+			Age:  rand.Intn(100),
+		}
+		db.Insert(doc)
+		unindexed.Insert(doc)
+	}
+
+	tests := []struct {
+		query Q
+		opts  FindOptions
+		index string
+	}{
+		{Q{"Age": Gt(50)}, FindOptions{Sort: []SortField{Asc("Age")}, Limit: 10}, "Age"},
+		{Q{"Age": Gt(50)}, FindOptions{Sort: []SortField{Desc("Age")}, Limit: 10}, "Age"},
+		{Q{"Name": "Test document 3"}, FindOptions{Sort: []SortField{Desc("Age")}, Start: 5, Limit: 10}, "Name-Age"},
+		{Q{}, FindOptions{Sort: []SortField{Asc("Name"), Asc("Age")}}, "Name-Age"},
+	}
+
+	for _, test := range tests {
+		idx, _, ok := db.sortIndex(test.query, test.opts.Sort)
+		if assert.True(t, ok, "index is used to sort %v", test.opts.Sort) {
+			assert.Equal(t, idx.Name, test.index)
+		}
+
+		n, docs := db.FindWithOptions(test.query, test.opts)
+		n2, expected := unindexed.FindWithOptions(test.query, test.opts)
+		assert.Equal(t, n, n2, "count matches unindexed count")
+		assert.Equal(t, sortedAges(docs), sortedAges(expected), "order matches unindexed sort")
+	}
+
+	_, _, ok := db.sortIndex(Q{}, []SortField{Asc("Name"), Desc("Age")})
+	assert.False(t, ok, "index isn't used for mixed directions")
+}
+
+func TestFindSortedTieBreak(t *testing.T) {
+	db := NewDatabase()
+	db.NewIndexWithOptions([]string{"A", "B"}, Ordered())
+	db.Insert(
+		map[string]interface{}{"A": 2, "B": "z"},
+		map[string]interface{}{"A": 2.0, "B": "a"},
+		map[string]interface{}{"A": int64(2), "B": "m"},
+		map[string]interface{}{"A": 1, "B": "q"},
+	)
+
+	opts := FindOptions{Sort: []SortField{Asc("A"), Asc("B")}}
+	_, docs := db.FindWithOptions(nil, opts)
+	bs := make([]interface{}, len(docs))
+	for i, d := range docs {
+		bs[i] = d.Fields["B"]
+	}
+	assert.Equal(t, bs, []interface{}{"q", "a", "m", "z"}, "equal numbers of different types are ordered by the next field")
+	assert.Equal(t, db.Explain(nil, opts).Sort, "index")
+
+	opts = FindOptions{Sort: []SortField{Desc("B")}}
+	_, docs = db.FindWithOptions(Q{"A": 2.0}, opts)
+	assert.Equal(t, len(docs), 3, "equal numbers share a prefix")
+	assert.Equal(t, docs[0].Fields["B"], "z", "sorted by the field after a fixed number")
+	assert.Equal(t, db.Explain(Q{"A": 2.0}, opts).Sort, "index")
+}
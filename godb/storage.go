@@ -0,0 +1,266 @@
+package godb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/ian-kent/go-log/log"
+	"hash/crc32"
+	"os"
+	"sync"
+)
+
+var ErrNotDataFile = errors.New("Not a data file")
+var ErrBadOffset = errors.New("Invalid document offset")
+
+// Storage holds document bodies outside of the Document structs. A
+// database with a Storage keeps only the ObjectID and an offset for
+// each document in memory, and loads the fields on demand.
+type Storage interface {
+	// Put stores a document body and returns its offset
+	Put(id ObjectID, fields map[string]interface{}) (int64, error)
+	// Get loads the fields of the document stored at offset
+	Get(offset int64) (map[string]interface{}, error)
+	// Delete marks the document stored at offset as removed
+	Delete(offset int64) error
+	// Each calls fn for every stored document, in the order they were
+	// last written
+	Each(fn func(offset int64, id ObjectID) error) error
+	Close() error
+}
+
+var dataMagic = []byte("GODBDATA")
+
+const (
+	// the data file header is the magic bytes followed by the offset
+	// of the end of the last record
+	dataHeaderSize = 16
+	// each record is a uint32 length, a CRC-32 and a status byte
+	recordHeaderSize = 9
+	recordLive       = 1
+	recordDeleted    = 2
+)
+
+var MmapInitialSize int64 = 1 << 20
+
+// MmapStorage is a Storage backed by a memory-mapped, append-only data
+// file. The file is grown by doubling and remapped as it fills.
+type MmapStorage struct {
+	Path string
+	File *os.File
+	Data []byte
+	End  int64
+	Lock *sync.RWMutex
+}
+
+func NewMmapStorage(path string) (*MmapStorage, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	size := fi.Size()
+	if size == 0 {
+		size = MmapInitialSize
+		if err := f.Truncate(size); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if size < dataHeaderSize {
+		f.Close()
+		return nil, ErrNotDataFile
+	}
+
+	data, err := mmapFile(f, int(size))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	s := &MmapStorage{
+		Path: path,
+		File: f,
+		Data: data,
+		Lock: new(sync.RWMutex),
+	}
+
+	if fi.Size() == 0 {
+		copy(data, dataMagic)
+		s.setEnd(dataHeaderSize)
+	} else if !bytes.Equal(data[:len(dataMagic)], dataMagic) {
+		s.Close()
+		return nil, ErrNotDataFile
+	}
+	s.End = int64(binary.LittleEndian.Uint64(data[8:16]))
+	if s.End < dataHeaderSize || s.End > size {
+		s.Close()
+		return nil, ErrCorrupt
+	}
+
+	return s, nil
+}
+
+func (s *MmapStorage) setEnd(end int64) {
+	binary.LittleEndian.PutUint64(s.Data[8:16], uint64(end))
+	s.End = end
+}
+
+// grow remaps the file so it holds at least size bytes. The caller must
+// hold the write lock.
+func (s *MmapStorage) grow(size int64) error {
+	cur := int64(len(s.Data))
+	if size <= cur {
+		return nil
+	}
+	for cur < size {
+		cur *= 2
+	}
+
+	if err := munmapFile(s.Data); err != nil {
+		return err
+	}
+	s.Data = nil
+	if err := s.File.Truncate(cur); err != nil {
+		return err
+	}
+	data, err := mmapFile(s.File, int(cur))
+	if err != nil {
+		return err
+	}
+	s.Data = data
+
+	return nil
+}
+
+func (s *MmapStorage) Put(id ObjectID, fields map[string]interface{}) (int64, error) {
+	rec, err := appendFields(appendBytes(nil, id), fields)
+	if err != nil {
+		return 0, err
+	}
+
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+
+	offset := s.End
+	end := offset + recordHeaderSize + int64(len(rec))
+	if err := s.grow(end); err != nil {
+		return 0, err
+	}
+
+	hdr := s.Data[offset : offset+recordHeaderSize]
+	binary.LittleEndian.PutUint32(hdr[0:4], uint32(len(rec)))
+	binary.LittleEndian.PutUint32(hdr[4:8], crc32.ChecksumIEEE(rec))
+	hdr[8] = recordLive
+	copy(s.Data[offset+recordHeaderSize:], rec)
+	s.setEnd(end)
+
+	return offset, nil
+}
+
+// record returns the payload and status of the record at offset. The
+// caller must hold a lock.
+func (s *MmapStorage) record(offset int64) ([]byte, byte, error) {
+	if offset < dataHeaderSize || offset+recordHeaderSize > s.End {
+		return nil, 0, ErrBadOffset
+	}
+	hdr := s.Data[offset : offset+recordHeaderSize]
+	end := offset + recordHeaderSize + int64(binary.LittleEndian.Uint32(hdr[0:4]))
+	if end > s.End {
+		return nil, 0, ErrBadOffset
+	}
+	return s.Data[offset+recordHeaderSize : end], hdr[8], nil
+}
+
+func (s *MmapStorage) Get(offset int64) (map[string]interface{}, error) {
+	s.Lock.RLock()
+	defer s.Lock.RUnlock()
+
+	rec, _, err := s.record(offset)
+	if err != nil {
+		return nil, err
+	}
+	d := &decoder{buf: rec}
+	if _, err := d.readBytes(); err != nil {
+		return nil, err
+	}
+	return d.fields()
+}
+
+// Delete marks the record as deleted. The space isn't reclaimed.
+func (s *MmapStorage) Delete(offset int64) error {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+
+	if _, _, err := s.record(offset); err != nil {
+		return err
+	}
+	s.Data[offset+8] = recordDeleted
+	return nil
+}
+
+// Each walks the data file, verifying every record. If a record is
+// corrupt (from a crash mid-write) the file is cut back to the last
+// good record.
+func (s *MmapStorage) Each(fn func(offset int64, id ObjectID) error) error {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+
+	offset := int64(dataHeaderSize)
+	for offset < s.End {
+		rec, status, err := s.record(offset)
+		if err == nil && crc32.ChecksumIEEE(rec) != binary.LittleEndian.Uint32(s.Data[offset+4:offset+8]) {
+			err = ErrCorrupt
+		}
+		if err != nil {
+			log.Warn("Discarding data after offset %d in %s: %s", offset, s.Path, err)
+			s.setEnd(offset)
+			return nil
+		}
+
+		if status == recordLive {
+			d := &decoder{buf: rec}
+			id, err := d.readBytes()
+			if err != nil {
+				return err
+			}
+			if err := fn(offset, id); err != nil {
+				return err
+			}
+		}
+		offset += recordHeaderSize + int64(len(rec))
+	}
+
+	return nil
+}
+
+// Sync flushes the data file to disk
+func (s *MmapStorage) Sync() error {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+
+	return s.File.Sync()
+}
+
+func (s *MmapStorage) Close() error {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+
+	if s.Data != nil {
+		if err := munmapFile(s.Data); err != nil {
+			return err
+		}
+		s.Data = nil
+	}
+	if err := s.File.Sync(); err != nil {
+		s.File.Close()
+		return err
+	}
+	return s.File.Close()
+}
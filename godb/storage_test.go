@@ -0,0 +1,131 @@
+package godb
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestMmapStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godb.data")
+
+	s, err := NewMmapStorage(path)
+	assert.Nil(t, err, "no error creating storage")
+
+	db, err := NewDatabaseWithStorage(s)
+	assert.Nil(t, err, "no error creating database")
+	db.NewIndex("Name")
+
+	// enough documents to grow the data file past its initial size
+	batch := make([]interface{}, 0)
+	for i := 0; i < 40000; i++ {
+		batch = append(batch, &TestDoc{
+			Name: "Test document " + strconv.Itoa(i),
+			Age:  i % 50,
+		})
+	}
+	n, _, err := db.Insert(batch...)
+	assert.Nil(t, err, "no error inserting documents")
+	assert.Equal(t, n, 40000, "insert return value correct")
+	assert.True(t, int64(len(s.Data)) > MmapInitialSize, "data file has grown")
+	assert.Nil(t, db.Documents[0].Fields, "fields are not held in memory")
+
+	doc := db.FindOne(&struct{ Name string }{Name: "Test document 1234"}, 0)
+	if assert.NotNil(t, doc, "result for valid name") {
+		var d TestDoc
+		doc.Unmarshal(&d)
+		assert.Equal(t, d.Name, "Test document 1234")
+		assert.Equal(t, d.Age, 34)
+	}
+	err = db.Replace(db.Documents[0].ObjectID, &TestDoc{Name: "Replaced", Age: 0})
+	assert.Nil(t, err, "no error replacing")
+	doc = db.FindOne(&struct{ Name string }{Name: "Replaced"}, 0)
+	assert.NotNil(t, doc, "replaced document found")
+	assert.Nil(t, doc.Fields, "fields are not held in memory")
+
+	n, err = db.Delete(&struct{ Age int }{Age: 49}, 0)
+	assert.Nil(t, err, "no error deleting")
+	assert.Equal(t, n, 800, "800 documents deleted")
+
+	id := db.FindOne(&struct{ Name string }{Name: "Test document 39998"}, 0).ObjectID
+	assert.Nil(t, db.Close(), "no error closing database")
+
+	s, err = NewMmapStorage(path)
+	assert.Nil(t, err, "no error reopening storage")
+	db, err = NewDatabaseWithStorage(s)
+	assert.Nil(t, err, "no error reopening database")
+	defer db.Close()
+
+	assert.Equal(t, len(db.Documents), 39200, "deleted documents are not restored")
+	doc = db.FindOne(&struct{ Name string }{Name: "Test document 39998"}, 0)
+	if assert.NotNil(t, doc, "document is restored") {
+		assert.Equal(t, doc.ObjectID, id, "object id is restored")
+	}
+
+	assert.NotNil(t, db.FindOne(&struct{ Name string }{Name: "Replaced"}, 0), "replacement is restored")
+	assert.Nil(t, db.FindOne(&struct{ Name string }{Name: "Test document 0"}, 0), "replaced version is not restored")
+
+	n, docs := db.Find(&struct{ Age int }{Age: 7}, 0, 10)
+	assert.Equal(t, n, 800, "scan finds documents in storage")
+	if assert.NotEmpty(t, docs) {
+		var d TestDoc
+		docs[0].Unmarshal(&d)
+		assert.Equal(t, d.Name, "Test document 7")
+	}
+}
+
+func TestMmapStorageNotDataFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godb.wal")
+
+	db, _ := Open(path)
+	db.Insert(&TestDoc{Name: "Test document 1", Age: 1})
+	db.Close()
+
+	_, err := NewMmapStorage(path)
+	assert.Equal(t, err, ErrNotDataFile)
+}
+
+// failingStorage fails every Put after the first puts
+type failingStorage struct {
+	*MmapStorage
+	puts int
+}
+
+var errPutFailed = errors.New("Put failed")
+
+func (s *failingStorage) Put(id ObjectID, fields map[string]interface{}) (int64, error) {
+	if s.puts == 0 {
+		return 0, errPutFailed
+	}
+	s.puts--
+	return s.MmapStorage.Put(id, fields)
+}
+
+func TestMmapStorageFailedInsert(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godb.data")
+
+	s, err := NewMmapStorage(path)
+	assert.Nil(t, err, "no error creating storage")
+	db, err := NewDatabaseWithStorage(&failingStorage{MmapStorage: s, puts: 3})
+	assert.Nil(t, err, "no error creating database")
+
+	batch := make([]interface{}, 0)
+	for i := 0; i < 5; i++ {
+		batch = append(batch, &TestDoc{Name: "Test document " + strconv.Itoa(i), Age: i})
+	}
+	n, _, err := db.Insert(batch...)
+	assert.Equal(t, err, errPutFailed, "storage error is returned")
+	assert.Equal(t, n, 0, "no documents inserted")
+	assert.Equal(t, len(db.Documents), 0, "no documents in the database")
+	assert.Nil(t, db.Close(), "no error closing database")
+
+	s, err = NewMmapStorage(path)
+	assert.Nil(t, err, "no error reopening storage")
+	db, err = NewDatabaseWithStorage(s)
+	assert.Nil(t, err, "no error reopening database")
+	defer db.Close()
+
+	assert.Equal(t, len(db.Documents), 0, "stored documents of the failed insert are not restored")
+}
@@ -0,0 +1,114 @@
+package godb
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// ErrDuplicateKey is returned when a write would give a document the
+// same values as another in a Unique index. ObjectID is the document
+// already holding the values.
+type ErrDuplicateKey struct {
+	Index    string
+	ObjectID ObjectID
+}
+
+func (e *ErrDuplicateKey) Error() string {
+	return fmt.Sprintf("Duplicate key in index %s, held by document %s", e.Index, e.ObjectID.Hex())
+}
+
+// uniqueKeys holds the canonical values claimed in each unique index by
+// documents being written, which aren't in the indexes yet
+type uniqueKeys map[*Index]map[string]ObjectID
+
+// claim checks the values of a document being written against the
+// unique indexes and the values already claimed, then claims them. self
+// is the document being replaced, if any, which doesn't conflict with
+// itself.
+func (keys uniqueKeys) claim(idxs []*Index, id ObjectID, self *Document, fields map[string]interface{}) error {
+	claims := make(map[*Index][]string)
+	doc := &Document{ObjectID: id, Fields: fields}
+	for _, idx := range idxs {
+		if !idx.Unique || !idx.includes(doc, fields) {
+			continue
+		}
+		entries, _ := idx.docEntries(fields)
+		for _, e := range entries {
+			c := string(idx.canonical(e))
+			if other, ok := keys[idx][c]; ok && !bytes.Equal(other, id) {
+				return &ErrDuplicateKey{Index: idx.Name, ObjectID: other}
+			}
+			if d := idx.duplicate(e, self); d != nil {
+				return &ErrDuplicateKey{Index: idx.Name, ObjectID: d.ObjectID}
+			}
+			claims[idx] = append(claims[idx], c)
+		}
+	}
+
+	for idx, cs := range claims {
+		if keys[idx] == nil {
+			keys[idx] = make(map[string]ObjectID)
+		}
+		for _, c := range cs {
+			keys[idx][c] = id
+		}
+	}
+	return nil
+}
+
+// uniqueIndexes returns the database's unique indexes in name order, so
+// that the index reported for a duplicate doesn't depend on map order
+func (db *Database) uniqueIndexes() []*Index {
+	idxs := make([]*Index, 0)
+	for _, idx := range db.Indexes {
+		if idx.Unique {
+			idxs = append(idxs, idx)
+		}
+	}
+	sort.Slice(idxs, func(i, j int) bool {
+		return idxs[i].Name < idxs[j].Name
+	})
+	return idxs
+}
+
+// duplicate returns a document other than self in the index with values
+// equal to the entry's, if there is one
+func (idx *Index) duplicate(entry map[string]interface{}, self *Document) *Document {
+	c := idx.canonical(entry)
+	var found *Document
+	check := func(l *Leaf) bool {
+		for _, d := range l.Documents {
+			if d == self {
+				continue
+			}
+			if !l.Collided && !idx.Ordered {
+				found = d
+				return false
+			}
+			if bytes.Equal(idx.canonical(idx.leafEntry(d, l.Unsplit)), c) {
+				found = d
+				return false
+			}
+		}
+		return true
+	}
+
+	if !idx.Ordered {
+		if l := idx.FindLeaf(entry); l != nil {
+			check(l)
+		}
+		return found
+	}
+
+	// equal numbers of different types have different ordered keys,
+	// so walk the range holding all of them. A missing field is keyed
+	// as nil.
+	q := make(map[string]interface{}, len(idx.Fields))
+	for _, f := range idx.Fields {
+		q[f] = entry[f]
+	}
+	r, _, _ := idx.queryRange(q)
+	idx.Tree.Walk(r, check)
+	return found
+}
@@ -0,0 +1,118 @@
+package godb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+)
+
+func TestUniqueIndex(t *testing.T) {
+	for _, opts := range [][]IndexOption{{Unique()}, {Unique(), Ordered()}} {
+		db := NewDatabase()
+		err := db.NewIndexWithOptions([]string{"Name"}, opts...)
+		assert.Nil(t, err, "no error creating index")
+		db.NewIndexWithOptions([]string{"Age"}, opts...)
+
+		_, docs, err := db.Insert(&TestDoc{Name: "a", Age: 1}, &TestDoc{Name: "b", Age: 2})
+		assert.Nil(t, err, "no error inserting unique values")
+
+		n, _, err := db.Insert(&TestDoc{Name: "c", Age: 3}, &TestDoc{Name: "a", Age: 4})
+		assert.Equal(t, err, &ErrDuplicateKey{Index: "Name", ObjectID: docs[0].ObjectID})
+		assert.Equal(t, n, 0, "batch isn't inserted")
+		assert.Equal(t, len(db.Documents), 2, "db contains 2 documents")
+
+		_, _, err = db.Insert(map[string]interface{}{"Name": "d", "Age": int64(2)})
+		assert.Equal(t, err, &ErrDuplicateKey{Index: "Age", ObjectID: docs[1].ObjectID}, "equal numbers are duplicates")
+
+		n, inserted, err := db.InsertBatch(Partial,
+			&TestDoc{Name: "c", Age: 3},
+			&TestDoc{Name: "a", Age: 5},
+			&TestDoc{Name: "c", Age: 6},
+			&TestDoc{Name: "e", Age: 7},
+		)
+		assert.Equal(t, n, 2, "valid documents are inserted")
+		if assert.IsType(t, err, &BatchError{}) {
+			errs := err.(*BatchError).Errors
+			assert.Equal(t, len(errs), 2, "an error per failed document")
+			assert.Equal(t, errs[1], &ErrDuplicateKey{Index: "Name", ObjectID: docs[0].ObjectID})
+			assert.Equal(t, errs[2], &ErrDuplicateKey{Index: "Name", ObjectID: inserted[0].ObjectID}, "duplicates within a batch are found")
+		}
+
+		_, err = db.Update(Q{"Name": "b"}, &struct{ Name string }{Name: "a"})
+		assert.Equal(t, err, &ErrDuplicateKey{Index: "Name", ObjectID: docs[0].ObjectID})
+		assert.Nil(t, db.Replace(docs[1].ObjectID, &TestDoc{Name: "b", Age: 2}), "a document doesn't conflict with itself")
+		assert.Nil(t, db.Verify(), "indexes are consistent")
+	}
+}
+
+func TestUniqueIndexOnDuplicates(t *testing.T) {
+	db := NewDatabase()
+	_, docs, _ := db.Insert(&TestDoc{Name: "a"}, &TestDoc{Name: "a"})
+
+	err := db.NewIndexWithOptions([]string{"Name"}, Unique())
+	assert.Equal(t, err, &ErrDuplicateKey{Index: "Name", ObjectID: docs[0].ObjectID})
+	assert.Nil(t, db.GetIndex("Name"), "index isn't created")
+}
+
+func TestUniqueTag(t *testing.T) {
+	db := NewDatabase()
+	_, docs, err := db.Insert(&TestTaggedDoc{Name: "a", Email: "a@example.com"})
+	assert.Nil(t, err, "no error inserting")
+	assert.True(t, db.GetIndex("Email").Unique, "declared index is unique")
+
+	_, _, err = db.Insert(&TestTaggedDoc{Name: "b", Email: "a@example.com"})
+	assert.Equal(t, err, &ErrDuplicateKey{Index: "Email", ObjectID: docs[0].ObjectID})
+}
+
+func TestUniqueTagIsRetried(t *testing.T) {
+	db := NewDatabase()
+	db.Insert(map[string]interface{}{"Email": "a@example.com"}, map[string]interface{}{"Email": "a@example.com"})
+
+	_, _, err := db.Insert(&TestTaggedDoc{Name: "b", Email: "b@example.com"})
+	assert.IsType(t, err, &ErrDuplicateKey{}, "declared index over duplicates fails")
+	assert.Nil(t, db.GetIndex("Email"), "index isn't created")
+
+	db.Delete(Q{"Email": "a@example.com"}, 1)
+	_, _, err = db.Insert(&TestTaggedDoc{Name: "b", Email: "b@example.com"})
+	assert.Nil(t, err, "no error inserting once the duplicate is gone")
+	if assert.NotNil(t, db.GetIndex("Email"), "declaration is retried") {
+		assert.True(t, db.GetIndex("Email").Unique, "declared index is unique")
+	}
+
+	_, _, err = db.Insert(&TestTaggedDoc{Name: "c", Email: "b@example.com"})
+	assert.IsType(t, err, &ErrDuplicateKey{}, "constraint is enforced")
+}
+
+func TestUniqueTagConflicts(t *testing.T) {
+	db := NewDatabase()
+	db.NewIndex("Email")
+	_, _, err := db.Insert(&TestTaggedDoc{Name: "a", Email: "a@example.com"})
+	assert.Equal(t, err, ErrIndexOptionsConflict, "existing index isn't unique")
+	_, _, err = db.Insert(&TestTaggedDoc{Name: "b", Email: "a@example.com"})
+	assert.Equal(t, err, ErrIndexOptionsConflict, "tag isn't ignored on the next insert")
+	assert.Equal(t, len(db.Documents), 0, "nothing inserted")
+
+	db = NewDatabase()
+	db.NewIndexWithOptions([]string{"Email"}, Unique(), Ordered())
+	db.NewIndexWithOptions([]string{"name"}, Unique())
+	_, _, err = db.Insert(&TestTaggedDoc{Name: "a", Email: "a@example.com"})
+	assert.Nil(t, err, "existing unique index satisfies the tags")
+}
+
+func TestUniqueIndexIsLogged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godb.wal")
+	db, err := Open(path)
+	assert.Nil(t, err, "no error opening database")
+	db.NewIndexWithOptions([]string{"Name"}, Unique())
+	db.Insert(&TestDoc{Name: "a"})
+	assert.Nil(t, db.Close(), "no error closing database")
+
+	db, err = Open(path)
+	assert.Nil(t, err, "no error reopening database")
+	defer db.Close()
+	if assert.NotNil(t, db.GetIndex("Name"), "index is rebuilt") {
+		assert.True(t, db.GetIndex("Name").Unique, "unique option survives replay")
+	}
+	_, _, err = db.Insert(&TestDoc{Name: "a"})
+	assert.IsType(t, err, &ErrDuplicateKey{})
+}
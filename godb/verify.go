@@ -0,0 +1,99 @@
+package godb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var ErrIndexInconsistent = errors.New("Index is inconsistent with documents")
+
+// Verify cross-checks every index against a full scan of the documents.
+// Each document must be in the leaf for each of its keys and in no
+// other, every leaf must hold only live documents, and each index's
+// Count must match. It returns an error describing the first problem
+// found.
+func (db *Database) Verify() error {
+	db.WriteLock.RLock()
+	defer db.WriteLock.RUnlock()
+
+	if len(db.IDs) != len(db.Documents) {
+		return fmt.Errorf("%s: %d documents but %d ObjectIDs", ErrIndexInconsistent, len(db.Documents), len(db.IDs))
+	}
+	for _, idx := range db.Indexes {
+		if err := db.verifyIndex(idx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *Database) verifyIndex(idx *Index) error {
+	// the entries a scan says the index should hold, and the values of
+	// each key
+	want := make(map[string]map[*Document]bool)
+	values := make(map[string]map[string]interface{})
+	entries := 0
+	for _, d := range db.Documents {
+		if !idx.includes(d, d.Values()) {
+			continue
+		}
+		es, _ := idx.docEntries(d.Values())
+		for _, e := range es {
+			key := string(idx.Key(e))
+			if want[key] == nil {
+				want[key] = make(map[*Document]bool)
+				values[key] = e
+			}
+			want[key][d] = true
+			entries++
+		}
+	}
+
+	if idx.Count != entries {
+		return fmt.Errorf("%s: %s: Count is %d but documents have %d entries", ErrIndexInconsistent, idx.Name, idx.Count, entries)
+	}
+
+	var err error
+	found := make(map[string]int)
+	idx.Tree.Walk(keyRange{}, func(l *Leaf) bool {
+		key := string(l.Unsplit)
+		seen := make(map[*Document]bool, len(l.Documents))
+		for _, d := range l.Documents {
+			if seen[d] {
+				err = fmt.Errorf("%s: %s: leaf holds document %s twice", ErrIndexInconsistent, idx.Name, d.ObjectID.Hex())
+				return false
+			}
+			seen[d] = true
+			if db.IDs[string(d.ObjectID)] != d {
+				err = fmt.Errorf("%s: %s: leaf holds deleted document %s", ErrIndexInconsistent, idx.Name, d.ObjectID.Hex())
+				return false
+			}
+			if !want[key][d] {
+				err = fmt.Errorf("%s: %s: document %s is in the wrong leaf", ErrIndexInconsistent, idx.Name, d.ObjectID.Hex())
+				return false
+			}
+			if !idx.Ordered && !l.Collided && !bytes.Equal(l.Canonical, idx.canonical(idx.leafEntry(d, l.Unsplit))) {
+				err = fmt.Errorf("%s: %s: document %s doesn't have its leaf's values", ErrIndexInconsistent, idx.Name, d.ObjectID.Hex())
+				return false
+			}
+			found[key]++
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for key, docs := range want {
+		// every document found was wanted, so a missing one leaves
+		// the count short
+		if found[key] != len(docs) {
+			return fmt.Errorf("%s: %s: leaf has %d of %d documents", ErrIndexInconsistent, idx.Name, found[key], len(docs))
+		}
+		if l := idx.FindLeaf(values[key]); l == nil || string(l.Unsplit) != key {
+			return fmt.Errorf("%s: %s: leaf not found by its values", ErrIndexInconsistent, idx.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package godb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	db := NewDatabase()
+	db.NewIndex("Name")
+	db.NewIndexWithOptions([]string{"Age"}, Ordered())
+	db.NewIndex("Tags")
+
+	for i := 0; i < 100; i++ {
+		db.Insert(&TestPerson{
+			Name: "Test person " + strconv.Itoa(i%20),
+			Tags: []string{"tag" + strconv.Itoa(i%3), "all"},
+		})
+	}
+	db.Update(Q{"Name": "Test person 1"}, &struct{ Tags []string }{Tags: []string{"other"}})
+	db.Delete(Q{"Tags": "tag2"}, 0)
+	assert.Nil(t, db.Verify(), "indexes are consistent")
+
+	idx := db.GetIndex("Name")
+	idx.Count++
+	err := db.Verify()
+	if assert.NotNil(t, err, "wrong Count is found") {
+		assert.True(t, strings.HasPrefix(err.Error(), ErrIndexInconsistent.Error()))
+	}
+	idx.Count--
+
+	l := idx.FindLeaf(Q{"Name": "Test person 3"})
+	l.Documents = l.Documents[1:]
+	assert.NotNil(t, db.Verify(), "missing document is found")
+}
+
+func TestIndexVerifiesCollidedLeaf(t *testing.T) {
+	db := NewDatabase()
+	_, docs, _ := db.Insert(
+		&TestDoc{Name: "a", Age: 1},
+		&TestDoc{Name: "a", Age: 2},
+		&TestDoc{Name: "b", Age: 3},
+	)
+	db.NewIndex("Name")
+
+	// move b into a's leaf, as if their hashes collided
+	idx := db.GetIndex("Name")
+	idx.Remove(docs[2])
+	key := idx.Key(Q{"Name": "a"})
+	l := idx.Tree.Lookup(key)
+	l.AddDocument(docs[2], key)
+	l.addCanonical(idx.canonical(docs[2].Fields))
+	idx.Count++
+	assert.True(t, l.Collided, "leaf with different values is collided")
+
+	n, found := db.Find(Q{"Name": "a"}, 0, 0)
+	assert.Equal(t, n, 2, "collided documents are filtered out")
+	assert.Equal(t, found, docs[:2])
+	assert.Equal(t, db.Count(Q{"Name": "a"}), 2)
+	assert.Equal(t, idx.Histogram(), []Bucket{
+		{Values: []interface{}{"a"}, Count: 2},
+		{Values: []interface{}{"b"}, Count: 1},
+	}, "collided leaf is split by value")
+
+	assert.NotNil(t, db.Verify(), "misplaced document is found")
+}
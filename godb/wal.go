@@ -0,0 +1,307 @@
+package godb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/ian-kent/go-log/log"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+// Write-ahead log record types
+const (
+	opInsert byte = iota + 1
+	opNewIndex
+	opCheckpoint
+	opDelete
+	opReplace
+)
+
+// WAL is an append-only log of database mutations. Each record is
+// framed as a little-endian uint32 payload length, a CRC-32 of the
+// payload, then the payload itself.
+type WAL struct {
+	Path       string
+	File       *os.File
+	Lock       *sync.Mutex
+	Generation uint64
+}
+
+func OpenWAL(path string) (*WAL, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WAL{
+		Path: path,
+		File: f,
+		Lock: new(sync.Mutex),
+	}, nil
+}
+
+// Append writes the records to the end of the log in a single write and
+// syncs the file before returning.
+func (w *WAL) Append(records ...[]byte) error {
+	w.Lock.Lock()
+	defer w.Lock.Unlock()
+
+	n := 0
+	for _, rec := range records {
+		n += 8 + len(rec)
+	}
+
+	buf := make([]byte, 0, n)
+	for _, rec := range records {
+		var hdr [8]byte
+		binary.LittleEndian.PutUint32(hdr[0:4], uint32(len(rec)))
+		binary.LittleEndian.PutUint32(hdr[4:8], crc32.ChecksumIEEE(rec))
+		buf = append(buf, hdr[:]...)
+		buf = append(buf, rec...)
+	}
+
+	if _, err := w.File.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	if _, err := w.File.Write(buf); err != nil {
+		return err
+	}
+	return w.File.Sync()
+}
+
+// Replay calls fn for every record in the log, in order. A torn or
+// corrupt record at the tail of the log (from a crash mid-write) is
+// discarded and the file truncated back to the last good record.
+func (w *WAL) Replay(fn func(rec []byte) error) error {
+	w.Lock.Lock()
+	defer w.Lock.Unlock()
+
+	if _, err := w.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	fi, err := w.File.Stat()
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(w.File)
+	var good int64
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return w.truncateAt(good, err)
+		}
+
+		// a corrupt length mustn't allocate more than the file holds
+		n := int64(binary.LittleEndian.Uint32(hdr[0:4]))
+		if n > fi.Size()-good-int64(len(hdr)) {
+			return w.truncateAt(good, ErrCorrupt)
+		}
+		rec := make([]byte, n)
+		if _, err := io.ReadFull(r, rec); err != nil {
+			return w.truncateAt(good, err)
+		}
+		if crc32.ChecksumIEEE(rec) != binary.LittleEndian.Uint32(hdr[4:8]) {
+			return w.truncateAt(good, ErrCorrupt)
+		}
+
+		if err := fn(rec); err != nil {
+			return err
+		}
+		good += int64(len(hdr) + len(rec))
+	}
+}
+
+// Reset truncates the log and starts a new generation. It is called
+// once a snapshot containing every logged mutation has been written.
+func (w *WAL) Reset(generation uint64) error {
+	w.Lock.Lock()
+	if err := w.File.Truncate(0); err != nil {
+		w.Lock.Unlock()
+		return err
+	}
+	w.Lock.Unlock()
+
+	if err := w.Append(encodeCheckpoint(generation)); err != nil {
+		return err
+	}
+	w.Generation = generation
+	return nil
+}
+
+func (w *WAL) truncateAt(offset int64, cause error) error {
+	log.Warn("Discarding incomplete log record at offset %d in %s: %s", offset, w.Path, cause)
+	if err := w.File.Truncate(offset); err != nil {
+		return err
+	}
+	_, err := w.File.Seek(offset, io.SeekStart)
+	return err
+}
+
+func (w *WAL) Close() error {
+	w.Lock.Lock()
+	defer w.Lock.Unlock()
+
+	return w.File.Close()
+}
+
+func encodeInsert(doc *Document) ([]byte, error) {
+	return appendDocument([]byte{opInsert}, doc)
+}
+
+func encodeReplace(doc *Document) ([]byte, error) {
+	return appendDocument([]byte{opReplace}, doc)
+}
+
+func encodeNewIndex(idx *Index) ([]byte, error) {
+	return appendIndexDef([]byte{opNewIndex}, idx)
+}
+
+func encodeDelete(docs []*Document) []byte {
+	b := appendUvarint([]byte{opDelete}, uint64(len(docs)))
+	for _, doc := range docs {
+		b = appendBytes(b, doc.ObjectID)
+	}
+	return b
+}
+
+func encodeCheckpoint(generation uint64) []byte {
+	return appendUvarint([]byte{opCheckpoint}, generation)
+}
+
+// appendIndexDef writes an index's fields followed by its options
+func appendIndexDef(b []byte, idx *Index) ([]byte, error) {
+	b = appendUvarint(b, uint64(len(idx.Fields)))
+	for _, f := range idx.Fields {
+		b = appendString(b, f)
+	}
+	return appendFields(b, idx.options())
+}
+
+// indexDef reads an index definition. Definitions written before index
+// options existed have none, which the caller indicates with
+// withOptions.
+func (d *decoder) indexDef(withOptions bool) ([]string, []IndexOption, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return nil, nil, err
+	}
+	if n > uint64(len(d.buf)) {
+		return nil, nil, ErrCorrupt
+	}
+	fields := make([]string, n)
+	for i := range fields {
+		if fields[i], err = d.readString(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if !withOptions {
+		return fields, nil, nil
+	}
+	opts, err := d.fields()
+	if err != nil {
+		return nil, nil, err
+	}
+	return fields, indexOptions(opts), nil
+}
+
+// apply replays a single log record against the database
+func (db *Database) apply(rec []byte) error {
+	if len(rec) == 0 {
+		return ErrCorrupt
+	}
+	d := &decoder{buf: rec, off: 1}
+
+	switch rec[0] {
+	case opInsert:
+		doc, err := d.document()
+		if err != nil {
+			return err
+		}
+		db.insert(doc)
+	case opNewIndex:
+		fields, opts, err := d.indexDef(d.off < len(rec))
+		if err != nil {
+			return err
+		}
+		if err := db.NewIndexWithOptions(fields, opts...); err != nil && err != ErrIndexAlreadyExists {
+			return err
+		}
+	case opDelete:
+		n, err := d.uvarint()
+		if err != nil {
+			return err
+		}
+		if n > uint64(len(rec)) {
+			return ErrCorrupt
+		}
+		docs := make([]*Document, 0, n)
+		for i := uint64(0); i < n; i++ {
+			id, err := d.readBytes()
+			if err != nil {
+				return err
+			}
+			if doc := db.findByID(id); doc != nil {
+				docs = append(docs, doc)
+			}
+		}
+		db.remove(docs)
+	case opReplace:
+		doc, err := d.document()
+		if err != nil {
+			return err
+		}
+		existing := db.findByID(doc.ObjectID)
+		if existing == nil {
+			return ErrNotFound
+		}
+		db.update(existing, doc.Fields)
+	case opCheckpoint:
+		// generation markers are handled by replay
+	default:
+		return ErrCorrupt
+	}
+
+	return nil
+}
+
+// replay applies the log on top of a database loaded from a snapshot of
+// the given generation. A log from an older generation was already
+// folded into the snapshot, which happens if the process stopped between
+// writing the snapshot and resetting the log, so it is skipped and reset.
+func (db *Database) replay(wal *WAL, generation uint64) error {
+	first := true
+	stale := false
+	err := wal.Replay(func(rec []byte) error {
+		if first {
+			first = false
+			if len(rec) > 0 && rec[0] == opCheckpoint {
+				d := &decoder{buf: rec, off: 1}
+				g, err := d.uvarint()
+				if err != nil {
+					return err
+				}
+				wal.Generation = g
+			}
+			stale = wal.Generation < generation
+		}
+		if stale {
+			return nil
+		}
+		return db.apply(rec)
+	})
+	if err != nil {
+		return err
+	}
+
+	if wal.Generation < generation {
+		return wal.Reset(generation)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package godb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestOpenReplaysLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godb.wal")
+
+	db, err := Open(path)
+	assert.Nil(t, err, "no error opening database")
+
+	err = db.NewIndex("Name")
+	assert.Nil(t, err, "no error creating index")
+	err = db.NewIndexWithOptions([]string{"Age"}, Ordered())
+	assert.Nil(t, err, "no error creating index")
+
+	for i := 0; i < 100; i++ {
+		_, _, err := db.Insert(&TestDoc{
+			Name: "Test document " + strconv.Itoa(i),
+			Age:  i,
+		})
+		assert.Nil(t, err, "no error inserting document")
+	}
+	id := db.Documents[50].ObjectID
+	assert.Nil(t, db.Close(), "no error closing database")
+
+	db, err = Open(path)
+	assert.Nil(t, err, "no error reopening database")
+	defer db.Close()
+
+	assert.Equal(t, len(db.Documents), 100, "db contains 100 documents")
+	assert.Equal(t, db.Documents[50].ObjectID, id, "object id survives replay")
+	if assert.NotNil(t, db.GetIndex("Name"), "index is rebuilt") {
+		assert.Equal(t, db.GetIndex("Name").Count, 100, "index contains 100 documents")
+	}
+	if assert.NotNil(t, db.GetIndex("Age"), "index is rebuilt") {
+		assert.Equal(t, db.GetIndex("Age").Ordered, true, "index options survive replay")
+	}
+
+	doc := db.FindOne(&struct{ Name string }{Name: "Test document 50"}, 0)
+	if assert.NotNil(t, doc, "result for valid name") {
+		var d TestDoc
+		doc.Unmarshal(&d)
+		assert.Equal(t, d.Age, 50)
+	}
+}
+
+func TestOpenDiscardsTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godb.wal")
+
+	db, err := Open(path)
+	assert.Nil(t, err, "no error opening database")
+	db.Insert(&TestDoc{Name: "Test document 1", Age: 1})
+	db.Insert(&TestDoc{Name: "Test document 2", Age: 2})
+	db.Close()
+
+	fi, err := os.Stat(path)
+	assert.Nil(t, err)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	f.Write([]byte{0xff, 0x00, 0x00, 0x00, 0x01, 0x02})
+	f.Close()
+
+	db, err = Open(path)
+	assert.Nil(t, err, "no error reopening database")
+	assert.Equal(t, len(db.Documents), 2, "db contains 2 documents")
+
+	fi2, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, fi2.Size(), fi.Size(), "torn record is truncated")
+
+	_, _, err = db.Insert(&TestDoc{Name: "Test document 3", Age: 3})
+	assert.Nil(t, err, "no error inserting after recovery")
+	db.Close()
+
+	db, err = Open(path)
+	assert.Nil(t, err, "no error reopening database")
+	defer db.Close()
+	assert.Equal(t, len(db.Documents), 3, "db contains 3 documents")
+}
+
+func TestOpenDiscardsOversizedRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godb.wal")
+
+	db, err := Open(path)
+	assert.Nil(t, err, "no error opening database")
+	db.Insert(&TestDoc{Name: "Test document 1", Age: 1})
+	db.Close()
+
+	fi, err := os.Stat(path)
+	assert.Nil(t, err)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	f.Write([]byte{0xff, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00, 0x01})
+	f.Close()
+
+	db, err = Open(path)
+	assert.Nil(t, err, "no error reopening database")
+	defer db.Close()
+	assert.Equal(t, len(db.Documents), 1, "db contains 1 document")
+
+	fi2, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, fi2.Size(), fi.Size(), "record longer than the log is truncated")
+}
+
+func TestInsertUnsupportedTypeIsNotLogged(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "godb.wal"))
+	assert.Nil(t, err, "no error opening database")
+	defer db.Close()
+
+	n, _, err := db.Insert(&struct{ C chan int }{})
+	assert.NotNil(t, err, "error inserting unsupported type")
+	assert.Equal(t, n, 0, "nothing inserted")
+	assert.Equal(t, len(db.Documents), 0, "db contains 0 documents")
+}
+
+type TestStatus string
+
+type TestNamedKinds struct {
+	Status  TestStatus
+	Timeout time.Duration
+}
+
+func TestNamedKindsAreLogged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godb.wal")
+	db, err := Open(path)
+	assert.Nil(t, err, "no error opening database")
+	_, _, err = db.Insert(&TestNamedKinds{Status: "active", Timeout: time.Second})
+	assert.Nil(t, err, "no error inserting named kinds")
+	assert.Nil(t, db.Close(), "no error closing database")
+
+	db, err = Open(path)
+	assert.Nil(t, err, "no error reopening database")
+	defer db.Close()
+	if assert.Equal(t, len(db.Documents), 1, "db contains 1 document") {
+		var d TestNamedKinds
+		db.Documents[0].Unmarshal(&d)
+		assert.Equal(t, d, TestNamedKinds{Status: "active", Timeout: time.Second}, "named kinds round trip")
+	}
+}
+
+func TestDeleteIsLogged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godb.wal")
+
+	db, err := Open(path)
+	assert.Nil(t, err, "no error opening database")
+	db.NewIndex("Age")
+	for i := 0; i < 100; i++ {
+		db.Insert(&TestDoc{Name: "Test document " + strconv.Itoa(i), Age: i % 10})
+	}
+	n, err := db.Delete(&struct{ Age int }{Age: 5}, 0)
+	assert.Nil(t, err, "no error deleting")
+	assert.Equal(t, n, 10, "10 documents deleted")
+	db.Close()
+
+	db, err = Open(path)
+	assert.Nil(t, err, "no error reopening database")
+	defer db.Close()
+	assert.Equal(t, len(db.Documents), 90, "db contains 90 documents")
+	assert.Equal(t, db.GetIndex("Age").Count, 90, "index contains 90 documents")
+	assert.Nil(t, db.FindOne(&struct{ Age int }{Age: 5}, 0), "deleted documents not found")
+}
+
+func TestUpdateIsLogged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godb.wal")
+
+	db, err := Open(path)
+	assert.Nil(t, err, "no error opening database")
+	db.NewIndex("Age")
+	for i := 0; i < 100; i++ {
+		db.Insert(&TestDoc{Name: "Test document " + strconv.Itoa(i), Age: i % 10})
+	}
+	db.Update(&struct{ Age int }{Age: 5}, &struct{ Age int }{Age: 50})
+	db.Replace(db.Documents[0].ObjectID, &TestDoc{Name: "Replaced", Age: 0})
+	db.Close()
+
+	db, err = Open(path)
+	assert.Nil(t, err, "no error reopening database")
+	defer db.Close()
+	c, _ := db.Find(&struct{ Age int }{Age: 50}, 0, 10)
+	assert.Equal(t, c, 10, "updates are replayed")
+	assert.NotNil(t, db.FindOne(&struct{ Name string }{Name: "Replaced"}, 0), "replace is replayed")
+}
@@ -18,10 +18,12 @@ type MyDoc struct {
 }
 
 var db godb.Database
+var explain *bool
 
 func main() {
 	profile := flag.String("profile", "", "profile application")
 	loglevel := flag.String("loglevel", "DEBUG", "log level (ERROR, INFO, WARN, DEBUG, TRACE)")
+	explain = flag.Bool("explain", false, "log query plans")
 	flag.Parse()
 
 	log.Logger().SetLevel(log.Stol(*loglevel))
@@ -56,6 +58,12 @@ func timeIt(f func() int, msg string) {
 	log.Info("")
 }
 
+func explainQuery(query interface{}) {
+	if *explain {
+		log.Info("Query plan:\n%s", db.Explain(query, godb.FindOptions{Limit: 10}))
+	}
+}
+
 func indexMulti() int {
 	db.NewIndexes([]string{"Name"}, []string{"Age"}, []string{"Name", "Age"})
 	return (db.GetIndex("Name").Count + db.GetIndex("Age").Count + db.GetIndex("Name", "Age").Count) / 3
@@ -101,7 +109,7 @@ func insertStuff() int {
 				}
 			}
 			//log.Info("Created 1000 objects for insert %d", i)
-			n, _ := db.Insert(batch...)
+			n, _, _ := db.Insert(batch...)
 			//log.Info("Inserted %d complete", i)
 			ins += n
 		}(i)
@@ -112,7 +120,9 @@ func insertStuff() int {
 
 func findByQuery() int {
 	// Find a doc using a query
-	n, docs := db.Find(&struct{ Name string }{Name: "Test document 123"}, 0, 10)
+	query := &struct{ Name string }{Name: "Test document 123"}
+	explainQuery(query)
+	n, docs := db.Find(query, 0, 10)
 
 	if len(docs) > 0 {
 		var o MyDoc
@@ -125,7 +135,9 @@ func findByQuery() int {
 
 func findByQuery2() int {
 	// Find a doc using a query
-	n, docs := db.Find(&struct{ Age int }{Age: 45}, 0, 10)
+	query := &struct{ Age int }{Age: 45}
+	explainQuery(query)
+	n, docs := db.Find(query, 0, 10)
 
 	if len(docs) > 0 {
 		var o MyDoc
@@ -138,13 +150,15 @@ func findByQuery2() int {
 
 func findByQuery3() int {
 	// Find a doc using a query
-	n, docs := db.Find(&struct {
+	query := &struct {
 		Name string
 		Age  int
 	}{
 		Name: "Test document 3000",
 		Age:  50,
-	}, 0, 10)
+	}
+	explainQuery(query)
+	n, docs := db.Find(query, 0, 10)
 
 	if len(docs) > 0 {
 		var o MyDoc